@@ -0,0 +1,233 @@
+package erpc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// BalancedClient 负载均衡的客户端，为服务的每个实例维护一个Client，
+// 每次调用由Balancer选择一个实例
+type BalancedClient struct {
+	serviceName string
+	resolver    Resolver
+	balancer    Balancer
+	// 连接每个实例的Client使用的选项，Address由实例决定
+	options *ClientOptions
+	// 保证同一时间只有一个Update
+	updateMutex sync.Mutex
+	mutex       sync.RWMutex
+	nodes       []*Node
+	closed      bool
+}
+
+// NewBalancedClient 查找serviceName的实例并连接，至少有一个实例连接成功后返回；
+// balancer为nil时使用轮询
+func NewBalancedClient(serviceName string, resolver Resolver, balancer Balancer, options *ClientOptions) (*BalancedClient, error) {
+	if balancer == nil {
+		balancer = NewRoundRobinBalancer()
+	}
+	bc := &BalancedClient{
+		serviceName: serviceName,
+		resolver:    resolver,
+		balancer:    balancer,
+		options:     options,
+	}
+	err := bc.Refresh()
+	if err == nil {
+		err = bc.ready()
+	}
+	if err != nil {
+		bc.Close()
+		return nil, err
+	}
+	return bc, nil
+}
+
+// ready 等待至少一个节点连接成功，所有节点的第一次连接都完成后仍然没有已连接的节点时返回错误
+func (bc *BalancedClient) ready() error {
+	nodes := bc.Nodes()
+	connected := make(chan bool, len(nodes))
+	for _, node := range nodes {
+		go func(client *Client) {
+			client.waitDial()
+			connected <- client.connected()
+		}(node.Client)
+	}
+	for range nodes {
+		if <-connected {
+			return nil
+		}
+	}
+	return NewError(CodeUnavailable, "没有可用的服务实例: %s", bc.serviceName)
+}
+
+// Refresh 重新查找服务的实例并更新节点，查找失败时保留原来的节点
+func (bc *BalancedClient) Refresh() error {
+	instances, err := bc.resolver.Resolve(bc.serviceName)
+	if err != nil {
+		return err
+	}
+	return bc.Update(instances)
+}
+
+// Update 用新的实例列表更新节点：地址不变的实例继续使用原来的Client，
+// 新的实例在后台建立连接，消失的实例关闭连接。连接失败的实例也会保留，在后台重连，
+// 连接成功后开始分配请求；没有一个实例已连接或者正在连接时返回错误
+func (bc *BalancedClient) Update(instances []Instance) error {
+	bc.updateMutex.Lock()
+	defer bc.updateMutex.Unlock()
+	bc.mutex.RLock()
+	old := make(map[string]*Node, len(bc.nodes))
+	for _, node := range bc.nodes {
+		old[node.Instance.Address] = node
+	}
+	bc.mutex.RUnlock()
+
+	nodes := make([]*Node, 0, len(instances))
+	kept := make(map[string]bool, len(instances))
+	for _, instance := range instances {
+		if kept[instance.Address] {
+			continue
+		}
+		if node, ok := old[instance.Address]; ok {
+			nodes = append(nodes, &Node{Instance: instance, Client: node.Client, outstanding: node.outstanding})
+			kept[instance.Address] = true
+			continue
+		}
+		options := *bc.options
+		options.Address = instance.Address
+		options.Resolver = nil
+		client, err := newClient(&options, true)
+		if err != nil {
+			Warn("连接服务 %s 的实例 %s 失败: %s", bc.serviceName, instance.Address, err.Error())
+			continue
+		}
+		nodes = append(nodes, &Node{Instance: instance, Client: client, outstanding: new(int64)})
+		kept[instance.Address] = true
+	}
+
+	bc.mutex.Lock()
+	if bc.closed {
+		bc.mutex.Unlock()
+		for _, node := range nodes {
+			if _, ok := old[node.Instance.Address]; !ok {
+				node.Client.Close()
+			}
+		}
+		return ErrClientClosed
+	}
+	bc.nodes = nodes
+	bc.mutex.Unlock()
+	for address, node := range old {
+		if !kept[address] {
+			node.Client.Close()
+		}
+	}
+	if len(filterNodes(nodes, (*Client).connected)) == 0 && len(filterNodes(nodes, (*Client).connecting)) == 0 {
+		return NewError(CodeUnavailable, "没有可用的服务实例: %s", bc.serviceName)
+	}
+	return nil
+}
+
+// filterNodes 客户端满足ok的节点，全部满足时直接返回nodes
+func filterNodes(nodes []*Node, ok func(*Client) bool) []*Node {
+	for i, node := range nodes {
+		if ok(node.Client) {
+			continue
+		}
+		matched := append([]*Node(nil), nodes[:i]...)
+		for _, node := range nodes[i+1:] {
+			if ok(node.Client) {
+				matched = append(matched, node)
+			}
+		}
+		return matched
+	}
+	return nodes
+}
+
+// Nodes 当前的节点
+func (bc *BalancedClient) Nodes() []*Node {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+	return append([]*Node(nil), bc.nodes...)
+}
+
+// pick 用负载均衡策略选择一个节点
+func (bc *BalancedClient) pick() (*Node, error) {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+	if bc.closed {
+		return nil, ErrClientClosed
+	}
+	// 优先选择已连接的节点，其次是正在进行第一次连接的节点，请求等待连接完成；
+	// 都在重连时仍然选择一个，让调用返回连接错误
+	nodes := filterNodes(bc.nodes, (*Client).connected)
+	if len(nodes) == 0 {
+		nodes = filterNodes(bc.nodes, (*Client).connecting)
+	}
+	if len(nodes) == 0 {
+		nodes = bc.nodes
+	}
+	if len(nodes) == 0 {
+		return nil, NewError(CodeUnavailable, "没有可用的服务实例: %s", bc.serviceName)
+	}
+	return bc.balancer.Pick(nodes), nil
+}
+
+// do 选择一个节点执行调用，记录节点正在进行的请求数
+func (bc *BalancedClient) do(call func(client *Client) error) error {
+	node, err := bc.pick()
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(node.outstanding, 1)
+	defer atomic.AddInt64(node.outstanding, -1)
+	return call(node.Client)
+}
+
+// Call 调用RPC方法
+func (bc *BalancedClient) Call(serviceName string, methodName string, params []interface{}) (resp Response, err error) {
+	return bc.CallContext(context.Background(), serviceName, methodName, params...)
+}
+
+// CallContext 调用RPC方法，ctx被取消或者超过截止时间时立即返回
+func (bc *BalancedClient) CallContext(ctx context.Context, serviceName string, methodName string, params ...interface{}) (resp Response, err error) {
+	err = bc.do(func(client *Client) (err error) {
+		resp, err = client.CallContext(ctx, serviceName, methodName, params...)
+		return
+	})
+	return
+}
+
+// CallInto 调用RPC方法，并把结果数据解码到out中
+func (bc *BalancedClient) CallInto(ctx context.Context, serviceName string, methodName string, out interface{}, params ...interface{}) error {
+	return bc.do(func(client *Client) error {
+		return client.CallInto(ctx, serviceName, methodName, out, params...)
+	})
+}
+
+// Notify 发送单向请求
+func (bc *BalancedClient) Notify(serviceName string, methodName string, params ...interface{}) error {
+	return bc.do(func(client *Client) error {
+		return client.Notify(serviceName, methodName, params...)
+	})
+}
+
+// Close 关闭所有实例的Client
+func (bc *BalancedClient) Close() error {
+	bc.mutex.Lock()
+	if bc.closed {
+		bc.mutex.Unlock()
+		return nil
+	}
+	bc.closed = true
+	nodes := bc.nodes
+	bc.nodes = nil
+	bc.mutex.Unlock()
+	for _, node := range nodes {
+		node.Client.Close()
+	}
+	return nil
+}
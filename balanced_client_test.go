@@ -0,0 +1,82 @@
+package erpc_test
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/euphie/erpc"
+	"github.com/euphie/erpc/internal/testutil"
+	"github.com/euphie/erpc/registry"
+)
+
+// 手动登记的实例还没有监听时保留节点，开始监听后分配到请求
+func TestBalancedClientUnreachableNode(t *testing.T) {
+	m := registry.NewMemory()
+	testutil.Serve(t, 1, m)
+	testutil.WaitInstances(t, m, 1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	m.Register(erpc.Instance{ID: "late", ServiceName: "Who", Address: address})
+
+	bc, err := erpc.NewBalancedClient("Who", m, nil, testutil.ClientOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	if nodes := bc.Nodes(); len(nodes) != 2 {
+		t.Fatalf("期望2个节点，实际%d个", len(nodes))
+	}
+	if seen := testutil.Collect(t, bc, 4); !reflect.DeepEqual(seen, map[int]bool{1: true}) {
+		t.Fatalf("请求分配到了没有监听的实例: %v", seen)
+	}
+	if listener, err = net.Listen("tcp", address); err != nil {
+		t.Skipf("无法重新监听%s: %v", address, err)
+	}
+	go testutil.NewServer(t, 2, nil).Serve(listener)
+	testutil.Eventually(t, "开始监听后实例分配到请求", func() bool { return testutil.Collect(t, bc, 2)[2] })
+}
+
+// 连接不上的实例在后台连接，不阻塞创建客户端和更新节点
+func TestBalancedClientSlowDial(t *testing.T) {
+	m := registry.NewMemory()
+	testutil.Serve(t, 1, m)
+	testutil.WaitInstances(t, m, 1)
+	m.Register(erpc.Instance{ID: "slow", ServiceName: "Who", Address: "slow:1"})
+	release := make(chan struct{})
+	options := testutil.ClientOptions()
+	options.Dial = func(address string) (net.Conn, error) {
+		if strings.HasPrefix(address, "slow") {
+			<-release
+			return nil, net.ErrClosed
+		}
+		return net.Dial("tcp", address)
+	}
+
+	start := time.Now()
+	bc, err := erpc.NewBalancedClient("Who", m, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(release)
+	defer bc.Close()
+	if seen := testutil.Collect(t, bc, 4); !reflect.DeepEqual(seen, map[int]bool{1: true}) {
+		t.Fatalf("请求分配到了还在连接的实例: %v", seen)
+	}
+	m.Register(erpc.Instance{ID: "slow2", ServiceName: "Who", Address: "slow:2"})
+	if err := bc.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if len(bc.Nodes()) != 3 {
+		t.Fatalf("期望3个节点，实际%d个", len(bc.Nodes()))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("等待了连接不上的实例: %v", elapsed)
+	}
+}
@@ -0,0 +1,126 @@
+package erpc
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// Node 负载均衡的节点，对应服务的一个实例和连接它的客户端
+type Node struct {
+	Instance Instance
+	Client   *Client
+	// 正在进行的请求数，实例信息更新后新的节点和旧的节点共用
+	outstanding *int64
+}
+
+// Outstanding 正在进行的请求数
+func (node *Node) Outstanding() int64 {
+	return atomic.LoadInt64(node.outstanding)
+}
+
+// weight 节点的权重，没有设置时为1
+func (node *Node) weight() int {
+	if node.Instance.Weight > 0 {
+		return node.Instance.Weight
+	}
+	return 1
+}
+
+// Balancer 负载均衡策略，从不为空的nodes中选择一个节点，会被多个goroutine同时调用
+type Balancer interface {
+	Pick(nodes []*Node) *Node
+}
+
+// NewRoundRobinBalancer 轮询
+func NewRoundRobinBalancer() Balancer {
+	return new(roundRobinBalancer)
+}
+
+type roundRobinBalancer struct {
+	next uint64
+}
+
+func (b *roundRobinBalancer) Pick(nodes []*Node) *Node {
+	n := atomic.AddUint64(&b.next, 1)
+	return nodes[n%uint64(len(nodes))]
+}
+
+// NewWeightedRandomBalancer 按实例的权重随机选择
+func NewWeightedRandomBalancer() Balancer {
+	return weightedRandomBalancer{}
+}
+
+type weightedRandomBalancer struct{}
+
+func (weightedRandomBalancer) Pick(nodes []*Node) *Node {
+	total := 0
+	for _, node := range nodes {
+		total += node.weight()
+	}
+	r := rand.Intn(total)
+	for _, node := range nodes {
+		if r -= node.weight(); r < 0 {
+			return node
+		}
+	}
+	return nodes[len(nodes)-1]
+}
+
+// NewLeastOutstandingBalancer 选择正在进行的请求最少的节点，相同时轮流选择
+func NewLeastOutstandingBalancer() Balancer {
+	return new(leastOutstandingBalancer)
+}
+
+type leastOutstandingBalancer struct {
+	next uint64
+}
+
+func (b *leastOutstandingBalancer) Pick(nodes []*Node) *Node {
+	start := atomic.AddUint64(&b.next, 1)
+	var best *Node
+	for i := range nodes {
+		node := nodes[(start+uint64(i))%uint64(len(nodes))]
+		if best == nil || node.Outstanding() < best.Outstanding() {
+			best = node
+		}
+	}
+	return best
+}
+
+// NewP2CBalancer 随机选择两个节点，使用正在进行的请求较少的一个
+func NewP2CBalancer() Balancer {
+	return p2cBalancer{}
+}
+
+type p2cBalancer struct{}
+
+func (p2cBalancer) Pick(nodes []*Node) *Node {
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	i := rand.Intn(len(nodes))
+	j := rand.Intn(len(nodes) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := nodes[i], nodes[j]
+	if b.Outstanding() < a.Outstanding() {
+		return b
+	}
+	return a
+}
+
+// NewBalancer 按名称新建负载均衡策略：round_robin、weighted_random、least_outstanding、p2c
+func NewBalancer(name string) (Balancer, error) {
+	switch name {
+	case "", "round_robin":
+		return NewRoundRobinBalancer(), nil
+	case "weighted_random":
+		return NewWeightedRandomBalancer(), nil
+	case "least_outstanding":
+		return NewLeastOutstandingBalancer(), nil
+	case "p2c":
+		return NewP2CBalancer(), nil
+	}
+	return nil, NewError(CodeInvalidArgument, "不支持的负载均衡策略: %s", name)
+}
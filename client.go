@@ -1,26 +1,77 @@
 package erpc
 
 import (
-	"errors"
+	"context"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	// ErrTimeout 请求超时
+	ErrTimeout = NewError(CodeDeadlineExceeded, "请求超时")
+	// ErrCanceled 请求被取消
+	ErrCanceled = NewError(CodeCanceled, "请求已取消")
+	// ErrConnClosed 连接已断开，请求可能没有发送或者没有收到响应
+	ErrConnClosed = NewError(CodeUnavailable, "连接已断开")
+	// ErrClientClosed 客户端已关闭
+	ErrClientClosed = NewError(CodeUnavailable, "客户端已关闭")
+)
+
+// SelectMode 连接池选择连接的方式
+type SelectMode int
+
+const (
+	// RoundRobin 轮询
+	RoundRobin SelectMode = iota
+	// LeastPending 选择等待响应最少的连接
+	LeastPending
+)
+
 // ClientOptions RPC客户端选项
 type ClientOptions struct {
 	Address  string
 	Protocol *Protocol
-	Timeout  time.Duration
+	// 默认超时时间(秒)，ctx没有设置截止时间时使用
+	Timeout time.Duration
+	// 建立连接的方法，为空时使用TCP连接Address
+	Dial func(address string) (net.Conn, error)
+	// 使用TCP建立连接的超时时间，默认5秒
+	DialTimeout time.Duration
+	// 支持的协议，按优先顺序排列，不为空时连接后和服务端协商使用的协议，
+	// Codec为空时使用RegisterCodec注册的编码器
+	Protocols []*Protocol
+	// 连接池大小，默认1
+	PoolSize int
+	// 选择连接的方式，默认轮询
+	Select SelectMode
+	// 重连的初始间隔，每次失败后翻倍，默认100毫秒
+	ReconnectInterval time.Duration
+	// 重连的最大间隔，默认30秒
+	MaxReconnectInterval time.Duration
+	// 写超时，一个消息超过这个时间没有写完时断开连接，默认10秒
+	WriteTimeout time.Duration
+	// 心跳间隔，0表示不发送心跳；超过3个间隔没有收到任何数据并且写入也没有进展时认为连接已断开
+	HeartbeatInterval time.Duration
+	// 拦截器，按顺序包裹请求的发送，第一个在最外层
+	Interceptors []ClientInterceptor
+	// 服务发现，不为空时忽略Address，每次建立连接时查找ServiceName的实例，
+	// 轮流连接不同的实例
+	Resolver    Resolver
+	ServiceName string
 }
 
-// Client RPC客户端
+// Client RPC客户端，连接断开后自动重连
 type Client struct {
 	options *ClientOptions
-	mutex   sync.Mutex
-	conn    net.Conn
-	pool    map[uint64]*Call
-	seq     uint64
+	conns   []*clientConn
+	// 轮询计数
+	next uint64
+	// 服务发现的实例轮询计数
+	nextInstance uint64
+	closeOnce    sync.Once
+	closing      chan struct{}
 }
 
 // Call RPC调用
@@ -29,87 +80,321 @@ type Call struct {
 	Resp  *Response
 	Done  chan *Call
 	Error error
+	// 发送请求的连接
+	conn *wire
+	// 流式调用的状态
+	stream *clientStreamState
 }
 
-func (client *Client) dispatch() {
-	for {
-		resp, err := client.options.Protocol.Codec.GetResponse(client.conn)
-		if err != nil {
-			Error("获取响应失败: %s", err.Error())
-			continue
+// done 通知调用完成，Done已满时丢弃，和net/rpc一样由调用方保证Done有足够的缓冲
+func (c *Call) done() {
+	if c.stream != nil {
+		c.stream.window.close()
+	}
+	select {
+	case c.Done <- c:
+	default:
+		Warn("Done缓冲不足, 丢弃调用结果: %s.%s", c.Req.ServiceName, c.Req.MethodName)
+	}
+}
+
+// dial 建立连接并协商协议
+func (client *Client) dial() (conn net.Conn, protocol *Protocol, err error) {
+	options := client.options
+	address := options.Address
+	if options.Resolver != nil {
+		if address, err = client.resolve(); err != nil {
+			return
 		}
-		call, ok := client.pool[resp.Seq]
-		if !ok {
-			//可能发送就失败了，或者服务端错误，先忽略
-			continue
-		} else {
-			call.Resp = &resp
+	}
+	if options.Dial != nil {
+		conn, err = options.Dial(address)
+	} else {
+		timeout := options.DialTimeout
+		if timeout <= 0 {
+			timeout = defaultDialTimeout
 		}
-		call.done()
+		conn, err = net.DialTimeout("tcp", address, timeout)
+	}
+	if err != nil {
+		return
 	}
+	protocol = options.Protocol
+	if len(options.Protocols) > 0 {
+		raw := conn
+		if conn, protocol, err = clientHandshake(raw, options.Protocols); err != nil {
+			raw.Close()
+			return
+		}
+	}
+	return
 }
 
-func (c *Call) done() {
-	select {
-	case c.Done <- c:
+// resolve 通过服务发现选择一个实例的地址
+func (client *Client) resolve() (string, error) {
+	instances, err := client.options.Resolver.Resolve(client.options.ServiceName)
+	if err != nil {
+		return "", err
 	}
+	if len(instances) == 0 {
+		return "", NewError(CodeNotFound, "没有可用的服务实例: %s", client.options.ServiceName)
+	}
+	n := atomic.AddUint64(&client.nextInstance, 1)
+	return instances[n%uint64(len(instances))].Address, nil
 }
 
-func (client *Client) request(req *Request) *Call {
-	call := new(Call)
-	client.mutex.Lock()
-	defer client.mutex.Unlock()
-	client.seq++
-	client.pool[client.seq] = call
-	req.Seq = client.seq
-	call.Req = req
-	call.Done = make(chan *Call)
-	err := client.options.Protocol.Codec.SendRequest(client.conn, *req)
-	if err != nil {
-		call.Error = err
-		call.done()
+// pick 从连接池中选择一个连接，优先选择已连接的
+func (client *Client) pick() *clientConn {
+	conns := client.conns
+	if len(conns) == 1 {
+		return conns[0]
+	}
+	if client.options.Select == LeastPending {
+		var best *clientConn
+		min := -1
+		for _, cc := range conns {
+			if n, ok := cc.pending(); ok && (min < 0 || n < min) {
+				best, min = cc, n
+			}
+		}
+		if best != nil {
+			return best
+		}
+		return conns[0]
+	}
+	n := atomic.AddUint64(&client.next, 1)
+	for i := range conns {
+		cc := conns[(n+uint64(i))%uint64(len(conns))]
+		if _, ok := cc.pending(); ok {
+			return cc
+		}
 	}
+	return conns[n%uint64(len(conns))]
+}
 
-	return call
+// withTimeout ctx没有截止时间时使用默认超时时间
+func (client *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); !ok && client.options.Timeout > 0 {
+		return context.WithTimeout(ctx, time.Second*client.options.Timeout)
+	}
+	return ctx, func() {}
 }
 
-func (client *Client) call(req *Request) (resp Response, err error) {
-	call := new(Call)
+func (client *Client) call(ctx context.Context, cc *clientConn, req *Request) (resp Response, err error) {
+	if err = ctx.Err(); err != nil {
+		return resp, contextError(err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Deadline = deadline.UnixNano()
+	}
+	req.Metadata = MetadataFromContext(ctx)
+	call := &Call{Req: req, Done: make(chan *Call, 1)}
+	if err = cc.request(call, ctx.Done()); err != nil {
+		if ctx.Err() != nil {
+			return resp, contextError(ctx.Err())
+		}
+		return resp, err
+	}
 	select {
-	case call = <-client.request(req).Done:
-	case <-time.After(time.Second * client.options.Timeout):
-		call.Error = errors.New("请求超时")
+	case <-call.Done:
+		if call.Error != nil {
+			return resp, call.Error
+		}
+		return *call.Resp, nil
+	case <-ctx.Done():
+		if cc.remove(req.Seq) != nil {
+			cc.cancel(call)
+		}
+		return resp, contextError(ctx.Err())
 	}
+}
 
-	return *call.Resp, call.Error
+// contextError 将context的错误转换成RPC错误
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return ErrCanceled
 }
 
-// Call 调用RPC方法
-func (client *Client) Call(serviceName string, methodName string, params []interface{}) (resp Response, err error) {
+// newRequest 生成请求
+func newRequest(codec Codec, serviceName string, methodName string, params []interface{}) (*Request, error) {
 	req := new(Request)
 	req.ServiceName = serviceName
 	req.MethodName = methodName
 	req.Params = make([]RequestParam, len(params))
 	for i, p := range params {
-		rp, err := GetRequestParam(p)
-		if err == nil {
-			req.Params[i] = rp
+		rp, err := GetRequestParam(p, codec)
+		if err != nil {
+			return nil, err
+		}
+		req.Params[i] = rp
+	}
+	return req, nil
+}
+
+// invoke 选择连接，经过拦截器发送请求，返回响应和连接使用的编码器
+func (client *Client) invoke(ctx context.Context, serviceName string, methodName string, params []interface{}) (resp Response, codec Codec, err error) {
+	ctx, cancel := client.withTimeout(ctx)
+	defer cancel()
+	cc := client.pick()
+	codec = cc.codec()
+	invoker := func(ctx context.Context, params []interface{}) (Response, error) {
+		req, err := newRequest(codec, serviceName, methodName, params)
+		if err != nil {
+			return Response{}, err
+		}
+		return client.call(ctx, cc, req)
+	}
+	info := &RequestInfo{ServiceName: serviceName, MethodName: methodName}
+	resp, err = chainClientInterceptors(client.options.Interceptors, info, invoker)(ctx, params)
+	return
+}
+
+// Go 异步调用RPC方法，立即返回*Call，调用完成后把它发送到done；
+// done为nil时新建一个缓冲为10的channel，done必须有缓冲，否则panic。
+// 使用默认超时时间，和CallContext一样经过拦截器；Call.Req只有服务名和方法名
+func (client *Client) Go(serviceName string, methodName string, done chan *Call, params ...interface{}) *Call {
+	if done == nil {
+		done = make(chan *Call, 10)
+	} else if cap(done) == 0 {
+		panic("erpc: done channel is unbuffered")
+	}
+	call := &Call{Req: &Request{ServiceName: serviceName, MethodName: methodName}, Done: done}
+	go func() {
+		resp, _, err := client.invoke(context.Background(), serviceName, methodName, params)
+		if err != nil {
+			call.Error = err
 		} else {
-			return resp, err
+			call.Resp = &resp
+		}
+		call.done()
+	}()
+	return call
+}
+
+// Notify 发送单向请求，服务端执行方法但不返回响应，请求写入连接后立即返回
+func (client *Client) Notify(serviceName string, methodName string, params ...interface{}) error {
+	cc := client.pick()
+	codec := cc.codec()
+	invoker := func(ctx context.Context, params []interface{}) (Response, error) {
+		req, err := newRequest(codec, serviceName, methodName, params)
+		if err != nil {
+			return Response{}, err
 		}
+		req.Type = MessageNotify
+		req.Metadata = MetadataFromContext(ctx)
+		return Response{}, cc.notify(req)
+	}
+	info := &RequestInfo{ServiceName: serviceName, MethodName: methodName}
+	_, err := chainClientInterceptors(client.options.Interceptors, info, invoker)(context.Background(), params)
+	return err
+}
+
+// Call 调用RPC方法
+func (client *Client) Call(serviceName string, methodName string, params []interface{}) (resp Response, err error) {
+	return client.CallContext(context.Background(), serviceName, methodName, params...)
+}
+
+// CallContext 调用RPC方法，ctx被取消或者超过截止时间时立即返回
+func (client *Client) CallContext(ctx context.Context, serviceName string, methodName string, params ...interface{}) (resp Response, err error) {
+	resp, _, err = client.invoke(ctx, serviceName, methodName, params)
+	return
+}
+
+// CallInto 调用RPC方法，并用编码器把结果数据解码到out中，out必须是指针；
+// 响应码为负数(ErrorCode)时返回*RPCError；业务自定义的0和正数响应码不视为失败，需要检查时用Call
+func (client *Client) CallInto(ctx context.Context, serviceName string, methodName string, out interface{}, params ...interface{}) error {
+	resp, codec, err := client.invoke(ctx, serviceName, methodName, params)
+	if err != nil {
+		return err
+	}
+	if err = resp.Err(); err != nil {
+		return err
+	}
+	if err = decode(codec, resp.Data, out); err != nil {
+		return wrapError(CodeInternal, err)
 	}
-	return client.call(req)
+	return nil
 }
 
-// NewClient 实例化一个RPC客户端
+// decode 把响应数据解码到out中
+func decode(codec Codec, data interface{}, out interface{}) error {
+	if out == nil || data == nil {
+		return nil
+	}
+	buf, err := codec.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(buf, out)
+}
+
+// Close 关闭客户端的所有连接，等待中的请求立即返回ErrClientClosed
+func (client *Client) Close() error {
+	client.closeOnce.Do(func() {
+		close(client.closing)
+		for _, cc := range client.conns {
+			cc.close()
+		}
+	})
+	return nil
+}
+
+// NewClient 实例化一个RPC客户端，连接池中的连接都建立成功后返回
 func NewClient(options *ClientOptions) (client *Client, err error) {
+	return newClient(options, false)
+}
+
+// newClient lazy为true时在后台建立连接，实例暂时不可用时也能先创建客户端，
+// 第一次连接完成之前请求等待，之后连接失败时在后台重连
+func newClient(options *ClientOptions, lazy bool) (client *Client, err error) {
 	client = new(Client)
 	client.options = options
-	client.pool = make(map[uint64]*Call)
-	client.conn, err = net.Dial("tcp", options.Address)
-	if err != nil {
-		return nil, err
+	client.closing = make(chan struct{})
+	size := options.PoolSize
+	if size <= 0 {
+		size = 1
 	}
-	go client.dispatch()
-	return
+	client.conns = make([]*clientConn, size)
+	for i := range client.conns {
+		cc := newClientConn(client)
+		client.conns[i] = cc
+		if lazy {
+			cc.dial()
+			continue
+		}
+		if err = cc.connect(); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// connected 连接池中是否有已连接的连接
+func (client *Client) connected() bool {
+	for _, cc := range client.conns {
+		if _, ok := cc.pending(); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// waitDial 等待连接池中的连接都完成第一次连接
+func (client *Client) waitDial() {
+	for _, cc := range client.conns {
+		cc.waitDial(nil)
+	}
+}
+
+// connecting 连接池中是否有正在进行第一次连接的连接
+func (client *Client) connecting() bool {
+	for _, cc := range client.conns {
+		if cc.connecting() {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,485 @@
+package erpc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultReconnectInterval    = 100 * time.Millisecond
+	defaultMaxReconnectInterval = 30 * time.Second
+	defaultWriteTimeout         = 10 * time.Second
+	defaultDialTimeout          = 5 * time.Second
+	// 写入时记录进展的分段大小
+	wireChunk = 32 * 1024
+)
+
+// wire 客户端的一个网络连接和它使用的编码器，写入需要占用写锁，
+// 读取只在dispatch中进行，写入阻塞时不影响等待队列
+type wire struct {
+	net.Conn
+	codec Codec
+	// 写锁，用channel实现，等待时可以被取消
+	writing chan struct{}
+	timeout time.Duration
+	// 最后一次读写有进展的时间(UnixNano)，读写大的消息时也在更新
+	lastActive int64
+}
+
+func newWire(conn net.Conn, codec Codec, timeout time.Duration) *wire {
+	if timeout <= 0 {
+		timeout = defaultWriteTimeout
+	}
+	return &wire{Conn: conn, codec: codec, writing: make(chan struct{}, 1), timeout: timeout, lastActive: time.Now().UnixNano()}
+}
+
+func (w *wire) Read(b []byte) (int, error) {
+	n, err := w.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&w.lastActive, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Write 分段写入并记录进展，对方读取得慢时写入大的消息需要很长时间，有进展就说明连接可用
+func (w *wire) Write(b []byte) (n int, err error) {
+	for n < len(b) {
+		end := n + wireChunk
+		if end > len(b) {
+			end = len(b)
+		}
+		var m int
+		m, err = w.Conn.Write(b[n:end])
+		n += m
+		if m > 0 {
+			atomic.StoreInt64(&w.lastActive, time.Now().UnixNano())
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// write 占用写锁后写入一个请求，超过写超时没有写完时返回错误；
+// cancel被关闭时放弃等待写锁，返回errWriteCanceled
+func (w *wire) write(req Request, cancel <-chan struct{}) error {
+	select {
+	case w.writing <- struct{}{}:
+	case <-cancel:
+		return errWriteCanceled
+	}
+	defer func() { <-w.writing }()
+	w.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.codec.SendRequest(w, req)
+}
+
+// tryWrite 写锁空闲时写入，否则放弃，返回是否写入
+func (w *wire) tryWrite(req Request) (bool, error) {
+	select {
+	case w.writing <- struct{}{}:
+	default:
+		return false, nil
+	}
+	defer func() { <-w.writing }()
+	w.SetWriteDeadline(time.Now().Add(w.timeout))
+	return true, w.codec.SendRequest(w, req)
+}
+
+// errWriteCanceled 等待写锁时请求被取消
+var errWriteCanceled = errors.New("等待写入时被取消")
+
+// clientConn 连接池中的一个连接，断开后按指数退避重连
+type clientConn struct {
+	client *Client
+	mutex  sync.Mutex
+	// 为nil时表示连接已断开，正在重连
+	conn     *wire
+	protocol *Protocol
+	pool     map[uint64]*Call
+	seq      uint64
+	closed   bool
+	// 正在进行第一次连接时不为nil(延迟创建的客户端或者收到GoAway之后)，连接完成后关闭，
+	// 等待的请求继续
+	dialing chan struct{}
+}
+
+func newClientConn(client *Client) *clientConn {
+	cc := new(clientConn)
+	cc.client = client
+	cc.protocol = client.options.Protocol
+	cc.pool = make(map[uint64]*Call)
+	if client.options.HeartbeatInterval > 0 {
+		go cc.heartbeat(client.options.HeartbeatInterval)
+	}
+	return cc
+}
+
+// connect 建立连接并开始接收响应
+func (cc *clientConn) connect() error {
+	raw, protocol, err := cc.client.dial()
+	if err != nil {
+		return wrapError(CodeUnavailable, err)
+	}
+	conn := newWire(raw, protocol.Codec, cc.client.options.WriteTimeout)
+	cc.mutex.Lock()
+	if cc.closed {
+		cc.mutex.Unlock()
+		raw.Close()
+		return ErrClientClosed
+	}
+	cc.conn = conn
+	cc.protocol = protocol
+	cc.mutex.Unlock()
+	go cc.dispatch(conn)
+	return nil
+}
+
+// reconnect 按指数退避重连，直到成功或者客户端关闭；immediate为true时立即进行第一次连接
+func (cc *clientConn) reconnect(immediate bool) {
+	options := cc.client.options
+	delay := options.ReconnectInterval
+	if delay <= 0 {
+		delay = defaultReconnectInterval
+	}
+	max := options.MaxReconnectInterval
+	if max <= 0 {
+		max = defaultMaxReconnectInterval
+	}
+	for {
+		if !immediate {
+			select {
+			case <-time.After(delay):
+			case <-cc.client.closing:
+				return
+			}
+		}
+		err := cc.connect()
+		if immediate {
+			immediate = false
+			cc.dialed()
+		}
+		if err == nil {
+			Info("重连成功: %s", options.Address)
+			return
+		}
+		if err == ErrClientClosed {
+			return
+		}
+		Warn("重连失败: %s, %v后重试", err.Error(), delay)
+		if delay *= 2; delay > max {
+			delay = max
+		}
+	}
+}
+
+func (cc *clientConn) dispatch(conn *wire) {
+	for {
+		resp, err := conn.codec.GetResponse(conn)
+		if err != nil {
+			cc.broken(conn, err)
+			return
+		}
+		if resp.Type == MessageGoAway {
+			cc.goAway(conn)
+			continue
+		}
+		if resp.Type == MessageStream || resp.Type == MessageWindow {
+			if call := cc.lookup(resp.Seq); call != nil && call.stream != nil {
+				if resp.Type == MessageStream {
+					call.stream.inbox.push(resp)
+				} else {
+					call.stream.window.grant(int(resp.Window))
+				}
+			}
+			continue
+		}
+		if resp.Type != MessageCall {
+			continue
+		}
+		call := cc.remove(resp.Seq)
+		if call == nil {
+			//可能发送就失败了，或者已经超时，先忽略
+			continue
+		}
+		call.Resp = &resp
+		call.done()
+	}
+}
+
+// broken 连接断开时让这个连接上等待中的请求立即失败，如果是当前使用的连接就开始重连
+func (cc *clientConn) broken(conn *wire, err error) {
+	cc.mutex.Lock()
+	current := cc.conn == conn
+	if current {
+		cc.conn = nil
+	}
+	var calls []*Call
+	for seq, call := range cc.pool {
+		if call.conn == conn {
+			calls = append(calls, call)
+			delete(cc.pool, seq)
+		}
+	}
+	closed := cc.closed
+	cc.mutex.Unlock()
+	conn.Close()
+	for _, call := range calls {
+		call.Error = ErrConnClosed
+		call.done()
+	}
+	if !current || closed {
+		return
+	}
+	Warn("连接断开: %s, 开始重连", err.Error())
+	go cc.reconnect(false)
+}
+
+// goAway 服务端正在关闭，立即建立新的连接，新的请求等待新连接建立后再发送；
+// 旧连接继续接收已发送请求的响应，直到服务端关闭它
+func (cc *clientConn) goAway(conn *wire) {
+	cc.mutex.Lock()
+	if cc.conn != conn || cc.closed {
+		cc.mutex.Unlock()
+		return
+	}
+	cc.conn = nil
+	cc.mutex.Unlock()
+	Info("服务端正在关闭连接: %s", cc.client.options.Address)
+	cc.dial()
+}
+
+// dial 在后台立即开始连接，第一次连接完成之前新的请求等待，失败后按指数退避重连
+func (cc *clientConn) dial() {
+	cc.mutex.Lock()
+	cc.dialing = make(chan struct{})
+	cc.mutex.Unlock()
+	go cc.reconnect(true)
+}
+
+// dialed 第一次连接已经完成，不论成功与否，等待的请求继续
+func (cc *clientConn) dialed() {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if cc.dialing != nil {
+		close(cc.dialing)
+		cc.dialing = nil
+	}
+}
+
+// waitDial 正在进行第一次连接时等待，请求不因为连接还没有建立而失败；
+// cancel被关闭时返回errWriteCanceled
+func (cc *clientConn) waitDial(cancel <-chan struct{}) error {
+	cc.mutex.Lock()
+	dialing := cc.dialing
+	cc.mutex.Unlock()
+	if dialing == nil {
+		return nil
+	}
+	select {
+	case <-dialing:
+		return nil
+	case <-cancel:
+		return errWriteCanceled
+	}
+}
+
+// heartbeat 定时发送心跳，超过3个间隔读写都没有进展时断开连接
+func (cc *clientConn) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-cc.client.closing:
+			return
+		}
+		cc.mutex.Lock()
+		conn := cc.conn
+		if conn == nil {
+			cc.mutex.Unlock()
+			continue
+		}
+		cc.mutex.Unlock()
+		last := time.Unix(0, atomic.LoadInt64(&conn.lastActive))
+		if time.Since(last) > 3*interval {
+			cc.broken(conn, ErrTimeout)
+			continue
+		}
+		// 正在写入其它消息时连接仍然在使用，跳过这次心跳，不排在大的消息后面
+		if _, err := conn.tryWrite(Request{Type: MessageHeartbeat}); err != nil {
+			cc.broken(conn, err)
+		}
+	}
+}
+
+// request 发送请求，请求没有发送出去时返回错误，同时通过call.Done通知；cancel被关闭时放弃等待写入
+func (cc *clientConn) request(call *Call, cancel <-chan struct{}) error {
+	req := call.Req
+	if err := cc.waitDial(cancel); err != nil {
+		call.Error = ErrCanceled
+		call.done()
+		return ErrCanceled
+	}
+	cc.mutex.Lock()
+	if cc.closed || cc.conn == nil {
+		err := ErrConnClosed
+		if cc.closed {
+			err = ErrClientClosed
+		}
+		call.Error = err
+		cc.mutex.Unlock()
+		call.done()
+		return err
+	}
+	conn := cc.conn
+	call.conn = conn
+	cc.seq++
+	cc.pool[cc.seq] = call
+	req.Seq = cc.seq
+	cc.mutex.Unlock()
+	// 写入时不持有cc.mutex，接收循环和其它请求不会等待网络
+	err := conn.write(*req, cancel)
+	if err == nil {
+		return nil
+	}
+	rerr := wrapError(CodeUnavailable, err)
+	if err == errWriteCanceled {
+		rerr = ErrCanceled
+	}
+	if cc.remove(req.Seq) != nil {
+		call.Error = rerr
+		call.done()
+	}
+	if err != errWriteCanceled {
+		cc.broken(conn, err)
+	}
+	return rerr
+}
+
+// notify 发送单向请求，不加入等待队列
+func (cc *clientConn) notify(req *Request) error {
+	cc.waitDial(nil)
+	cc.mutex.Lock()
+	if cc.closed {
+		cc.mutex.Unlock()
+		return ErrClientClosed
+	}
+	conn := cc.conn
+	if conn == nil {
+		cc.mutex.Unlock()
+		return ErrConnClosed
+	}
+	// 单向请求也使用唯一的序列，服务端按序列跟踪执行中的请求
+	cc.seq++
+	req.Seq = cc.seq
+	cc.mutex.Unlock()
+	if err := conn.write(*req, nil); err != nil {
+		cc.broken(conn, err)
+		return wrapError(CodeUnavailable, err)
+	}
+	return nil
+}
+
+// send 在流式调用的连接上发送流消息，cancel被关闭时放弃等待写入
+func (cc *clientConn) send(call *Call, req Request, cancel <-chan struct{}) error {
+	cc.mutex.Lock()
+	closed := cc.closed
+	cc.mutex.Unlock()
+	if closed {
+		return ErrClientClosed
+	}
+	if call.conn == nil {
+		return ErrConnClosed
+	}
+	err := call.conn.write(req, cancel)
+	if err == errWriteCanceled {
+		return ErrCanceled
+	}
+	if err != nil {
+		cc.broken(call.conn, err)
+		return wrapError(CodeUnavailable, err)
+	}
+	return nil
+}
+
+// lookup 查找等待中的请求，不移除
+func (cc *clientConn) lookup(seq uint64) *Call {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.pool[seq]
+}
+
+// remove 从等待队列中移除请求
+func (cc *clientConn) remove(seq uint64) *Call {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	call, ok := cc.pool[seq]
+	if !ok {
+		return nil
+	}
+	delete(cc.pool, seq)
+	return call
+}
+
+// cancel 通知服务端放弃请求，在发送请求的连接上发送，重连或者GoAway之后当前连接已经不是请求所在的连接；
+// 在后台写入，调用方不等待
+func (cc *clientConn) cancel(call *Call) {
+	cc.mutex.Lock()
+	closed := cc.closed
+	cc.mutex.Unlock()
+	if closed || call.conn == nil {
+		return
+	}
+	go func(conn *wire, req Request) {
+		if err := conn.write(req, nil); err != nil {
+			Warn("发送取消消息失败: %s", err.Error())
+		}
+	}(call.conn, Request{Type: MessageCancel, Seq: call.Req.Seq})
+}
+
+// codec 当前连接使用的编码器
+func (cc *clientConn) codec() Codec {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.protocol.Codec
+}
+
+// pending 等待响应的请求数，以及连接是否可用
+func (cc *clientConn) pending() (n int, ok bool) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return len(cc.pool), cc.conn != nil
+}
+
+// connecting 是否正在进行第一次连接
+func (cc *clientConn) connecting() bool {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.dialing != nil
+}
+
+// close 关闭连接，等待中的请求立即返回ErrClientClosed
+func (cc *clientConn) close() {
+	cc.mutex.Lock()
+	cc.closed = true
+	conn := cc.conn
+	cc.conn = nil
+	pool := cc.pool
+	cc.pool = make(map[uint64]*Call)
+	if cc.dialing != nil {
+		close(cc.dialing)
+		cc.dialing = nil
+	}
+	cc.mutex.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	for _, call := range pool {
+		call.Error = ErrClientClosed
+		call.done()
+	}
+}
@@ -0,0 +1,128 @@
+package erpc_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/euphie/erpc"
+	"github.com/euphie/erpc/internal/testutil"
+)
+
+func TestClientConcurrentCalls(t *testing.T) {
+	server := newTestServer(t, newTestService(), nil)
+	client := newTestClient(t, &erpc.ClientOptions{Dial: pipeDial(server, nil), PoolSize: 2})
+
+	// 同一个连接上的响应按序列交给对应的请求
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(text string) {
+			defer wg.Done()
+			var got string
+			if err := client.CallInto(context.Background(), "Test", "Echo", &got, text); err != nil || got != text {
+				t.Errorf("期望%s，实际%s %v", text, got, err)
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+}
+
+func TestClientCancel(t *testing.T) {
+	service := newTestService()
+	server := newTestServer(t, service, nil)
+	client := newTestClient(t, &erpc.ClientOptions{Dial: pipeDial(server, nil)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.CallInto(ctx, "Test", "Wait", new(int), 5000); erpc.Code(err) != erpc.CodeDeadlineExceeded {
+		t.Fatalf("期望DeadlineExceeded，实际%v", err)
+	}
+	// 客户端放弃后服务端的ctx也被取消
+	select {
+	case <-service.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("服务端没有收到取消")
+	}
+	var ms int
+	if err := client.CallInto(context.Background(), "Test", "Wait", &ms, 1); err != nil || ms != 1 {
+		t.Fatalf("取消之后连接不可用: %d %v", ms, err)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	server := newTestServer(t, newTestService(), nil)
+	conns := make(chan net.Conn, 10)
+	client := newTestClient(t, &erpc.ClientOptions{
+		Dial:              pipeDial(server, conns),
+		ReconnectInterval: 10 * time.Millisecond,
+	})
+
+	// 连接断开时等待中的请求立即失败，之后自动重连
+	done := client.Go("Test", "Wait", nil, 5000)
+	(<-conns).Close()
+	select {
+	case call := <-done.Done:
+		if erpc.Code(call.Error) != erpc.CodeUnavailable {
+			t.Fatalf("期望Unavailable，实际%v", call.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("连接断开后请求没有立即失败")
+	}
+	testutil.Eventually(t, "重连", func() bool {
+		var got string
+		return client.CallInto(context.Background(), "Test", "Echo", &got, "a") == nil && got == "a"
+	})
+}
+
+func TestClientGoAway(t *testing.T) {
+	old, next := newTestService(), newTestService()
+	oldServer, nextServer := newTestServer(t, old, nil), newTestServer(t, next, nil)
+	var dials int32
+	client := newTestClient(t, &erpc.ClientOptions{
+		// 重连间隔很长，GoAway之后不等待重连间隔
+		ReconnectInterval: time.Minute,
+		Dial: func(address string) (net.Conn, error) {
+			if atomic.AddInt32(&dials, 1) == 1 {
+				return pipeDial(oldServer, nil)(address)
+			}
+			return pipeDial(nextServer, nil)(address)
+		},
+	})
+
+	// 正在处理的请求在旧的服务器上完成
+	slow := client.Go("Test", "Wait", nil, 200)
+	time.Sleep(20 * time.Millisecond)
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- oldServer.Shutdown(context.Background()) }()
+
+	// 切换连接时新的请求不失败
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				var got string
+				if err := client.CallInto(context.Background(), "Test", "Echo", &got, "a"); err != nil {
+					t.Errorf("GoAway时请求失败: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if call := <-slow.Done; call.Error != nil || call.Resp.Err() != nil {
+		t.Fatalf("正在处理的请求失败: %v %v", call.Error, call.Resp)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&dials) != 2 {
+		t.Fatalf("期望重连一次，实际连接了%d次", dials)
+	}
+}
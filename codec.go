@@ -0,0 +1,50 @@
+package erpc
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// CodecFactory 生成编码器
+type CodecFactory func() Codec
+
+var codecs = struct {
+	sync.RWMutex
+	factories map[string]CodecFactory
+}{factories: make(map[string]CodecFactory)}
+
+// protocolKey 协议在注册表中的key
+func protocolKey(name string, version string) string {
+	return name + "/" + version
+}
+
+// RegisterCodec 注册编码器，name和version对应Protocol.Name和Protocol.Version，重复注册会覆盖
+func RegisterCodec(name string, version string, factory CodecFactory) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.factories[protocolKey(name, version)] = factory
+}
+
+// NewProtocol 用注册的编码器生成协议
+func NewProtocol(name string, version string) (*Protocol, error) {
+	codecs.RLock()
+	factory, ok := codecs.factories[protocolKey(name, version)]
+	codecs.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("不支持的协议: %s", protocolKey(name, version))
+	}
+	return &Protocol{Name: name, Version: version, Codec: factory()}, nil
+}
+
+// RegisteredProtocols 已注册的协议，格式为name/version
+func RegisteredProtocols() []string {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	keys := make([]string, 0, len(codecs.factories))
+	for k := range codecs.factories {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,259 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/euphie/erpc"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Registry 基于consul的注册中心
+type Registry struct {
+	client *consulapi.Client
+	// TCP健康检查的超时时间和间隔，例如"3s"、"10s"
+	CheckTimeout  string
+	CheckInterval string
+	// 不为空时使用TTL健康检查代替TCP检查，由实例定时向consul报告健康状态，例如"15s"
+	CheckTTL string
+	// 健康检查失败超过这个时间后consul自动注销实例，例如"1m"，为空时不自动注销
+	DeregisterAfter string
+	mutex           sync.Mutex
+	// TTL检查的实例ID对应的停止报告的channel
+	ttls map[string]chan struct{}
+	// 每个服务最后一次查询到的实例，consul暂时不可用时使用
+	cache map[string][]erpc.Instance
+}
+
+// NewRegistry 连接address上的consul agent
+func NewRegistry(address string) (*Registry, error) {
+	config := consulapi.DefaultConfig()
+	config.Address = address
+	client, err := consulapi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Registry{
+		client: client,
+		ttls:   make(map[string]chan struct{}),
+		cache:  make(map[string][]erpc.Instance),
+	}, nil
+}
+
+// Register 登记服务实例，consul通过TCP连接实例地址检查健康状态，
+// 设置了CheckTTL时改为定时报告健康状态
+func (r *Registry) Register(instance erpc.Instance) error {
+	host, port, err := splitAddress(instance.Address)
+	if err != nil {
+		return err
+	}
+	var ttl time.Duration
+	if r.CheckTTL != "" {
+		if ttl, err = parseTTL(r.CheckTTL); err != nil {
+			return err
+		}
+	}
+	registration := new(consulapi.AgentServiceRegistration)
+	registration.ID = instance.ID
+	registration.Name = instance.ServiceName
+	registration.Address = host
+	registration.Port = port
+	registration.Tags = instance.Tags
+	registration.Meta = instance.Meta
+	if instance.Weight > 0 {
+		registration.Weights = &consulapi.AgentWeights{Passing: instance.Weight, Warning: 1}
+	}
+
+	check := new(consulapi.AgentServiceCheck)
+	check.CheckID = checkID(instance)
+	check.DeregisterCriticalServiceAfter = r.DeregisterAfter
+	if r.CheckTTL != "" {
+		check.TTL = r.CheckTTL
+	} else {
+		check.TCP = instance.Address
+		check.Timeout = r.CheckTimeout
+		check.Interval = r.CheckInterval
+	}
+	registration.Check = check
+	if err = r.client.Agent().ServiceRegister(registration); err != nil {
+		return err
+	}
+	if ttl > 0 {
+		return r.startTTL(instance, ttl)
+	}
+	return nil
+}
+
+// 允许的最小TTL，consul的TTL检查精度是秒
+const minCheckTTL = time.Second
+
+// parseTTL 解析TTL健康检查的时间，不能小于minCheckTTL
+func parseTTL(value string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("TTL格式错误: %s", value)
+	}
+	if ttl < minCheckTTL {
+		return 0, fmt.Errorf("TTL不能小于%s: %s", minCheckTTL, value)
+	}
+	return ttl, nil
+}
+
+// Deregister 注销服务实例，停止报告健康状态
+func (r *Registry) Deregister(instance erpc.Instance) error {
+	r.mutex.Lock()
+	if stop, ok := r.ttls[instance.ID]; ok {
+		close(stop)
+		delete(r.ttls, instance.ID)
+	}
+	r.mutex.Unlock()
+	return r.client.Agent().ServiceDeregister(instance.ID)
+}
+
+// checkID 实例的健康检查ID
+func checkID(instance erpc.Instance) string {
+	return "service:" + instance.ID
+}
+
+// startTTL 立即报告一次健康状态，之后每隔TTL的三分之一报告一次
+func (r *Registry) startTTL(instance erpc.Instance, ttl time.Duration) error {
+	id := checkID(instance)
+	agent := r.client.Agent()
+	if err := agent.UpdateTTL(id, "", consulapi.HealthPassing); err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	r.mutex.Lock()
+	if old, ok := r.ttls[instance.ID]; ok {
+		close(old)
+	}
+	r.ttls[instance.ID] = stop
+	r.mutex.Unlock()
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := agent.UpdateTTL(id, "", consulapi.HealthPassing); err != nil {
+					erpc.Warn("报告服务 %s 健康状态失败: %s", instance.ID, err.Error())
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Resolve 查找服务健康的实例，查询失败时使用最后一次查询到的实例
+func (r *Registry) Resolve(serviceName string) ([]erpc.Instance, error) {
+	instances, _, err := r.health(serviceName, new(consulapi.QueryOptions))
+	if err != nil {
+		return r.stale(serviceName, err)
+	}
+	return instances, nil
+}
+
+// Watch 用consul的阻塞查询监听服务健康的实例，查询失败时保持原来的实例，等待一段时间后重试
+func (r *Registry) Watch(ctx context.Context, serviceName string) (<-chan []erpc.Instance, error) {
+	instances, index, err := r.health(serviceName, new(consulapi.QueryOptions))
+	if err != nil {
+		if instances, err = r.stale(serviceName, err); err != nil {
+			return nil, err
+		}
+	}
+	ch := make(chan []erpc.Instance, 1)
+	ch <- instances
+	go func() {
+		defer close(ch)
+		for ctx.Err() == nil {
+			q := &consulapi.QueryOptions{WaitIndex: index, WaitTime: watchWaitTime}
+			instances, last, err := r.health(serviceName, q.WithContext(ctx))
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				erpc.Warn("监听服务 %s 失败: %s", serviceName, err.Error())
+				select {
+				case <-time.After(watchRetryInterval):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			if last == index {
+				continue
+			}
+			// 索引变小说明consul重置了索引，重新开始阻塞查询
+			if last < index {
+				last = 0
+			}
+			index = last
+			select {
+			case ch <- instances:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return ch, nil
+}
+
+const (
+	// 阻塞查询的最长等待时间
+	watchWaitTime = 5 * time.Minute
+	// 查询失败后的重试间隔
+	watchRetryInterval = time.Second
+)
+
+func (r *Registry) health(serviceName string, q *consulapi.QueryOptions) ([]erpc.Instance, uint64, error) {
+	entries, meta, err := r.client.Health().Service(serviceName, "", true, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	instances := make([]erpc.Instance, 0, len(entries))
+	for _, entry := range entries {
+		s := entry.Service
+		address := s.Address
+		if address == "" && entry.Node != nil {
+			address = entry.Node.Address
+		}
+		instances = append(instances, erpc.Instance{
+			ID:          s.ID,
+			ServiceName: s.Service,
+			Address:     net.JoinHostPort(address, strconv.Itoa(s.Port)),
+			Weight:      s.Weights.Passing,
+			Tags:        s.Tags,
+			Meta:        s.Meta,
+		})
+	}
+	r.mutex.Lock()
+	r.cache[serviceName] = instances
+	r.mutex.Unlock()
+	return instances, meta.LastIndex, nil
+}
+
+// stale 查询失败时返回最后一次查询到的实例，没有查询成功过时返回err
+func (r *Registry) stale(serviceName string, err error) ([]erpc.Instance, error) {
+	r.mutex.Lock()
+	instances, ok := r.cache[serviceName]
+	r.mutex.Unlock()
+	if !ok {
+		return nil, err
+	}
+	erpc.Warn("查询服务 %s 失败: %s, 使用最后一次查询到的实例", serviceName, err.Error())
+	return append([]erpc.Instance(nil), instances...), nil
+}
+
+// splitAddress 拆分实例地址中的host和端口
+func splitAddress(address string) (host string, port int, err error) {
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	port, err = strconv.Atoi(p)
+	return
+}
@@ -1,12 +1,11 @@
 package consul
 
 import (
-	"errors"
-	"strconv"
+	"context"
+	"sync"
 
 	"github.com/euphie/erpc"
-	"github.com/euphie/erpc/protocol"
-	consulapi "github.com/hashicorp/consul/api"
+	_ "github.com/euphie/erpc/protocol"
 )
 
 func NewScheduler(file string) (sc *Scheduler) {
@@ -19,6 +18,17 @@ func NewScheduler(file string) (sc *Scheduler) {
 	if err := conf.Unmarshal(sc); err != nil {
 		panic(err)
 	}
+	if _, err := sc.newProtocol(); err != nil {
+		panic(err)
+	}
+	if _, err := erpc.NewBalancer(sc.Balancer); err != nil {
+		panic(err)
+	}
+	if sc.CheckTTL != "" {
+		if _, err := parseTTL(sc.CheckTTL); err != nil {
+			panic(err)
+		}
+	}
 
 	return
 }
@@ -27,69 +37,172 @@ func NewScheduler(file string) (sc *Scheduler) {
 type Scheduler struct {
 	Protocol      string `erpc:"server:protocol"`
 	ServerAddress string `erpc:"server:address"`
-	CheckTimeout  string `erpc:"check:timeout"`
-	CheckInterval string `erpc:"check:interval"`
-	ConsulAddress string `erpc:"consul:address"`
+	// 在consul登记的地址，为空时使用server:address
+	ServerAdvertise string `erpc:"server:advertise"`
+	ServerWeight    int    `erpc:"server:weight"`
+	// 多个标签用逗号分隔
+	ServerTags []string `erpc:"server:tags"`
+	// 元数据，例如version=1.2,zone=a
+	ServerMeta    map[string]string `erpc:"server:meta"`
+	CheckTimeout  string            `erpc:"check:timeout"`
+	CheckInterval string            `erpc:"check:interval"`
+	// 设置后使用TTL健康检查
+	CheckTTL             string `erpc:"check:ttl"`
+	CheckDeregisterAfter string `erpc:"check:deregister_after"`
+	ConsulAddress        string `erpc:"consul:address"`
+	// 客户端的负载均衡策略：round_robin、weighted_random、least_outstanding、p2c
+	Balancer string `erpc:"client:balancer"`
+
+	// 保护registry
+	mutex    sync.Mutex
+	registry *Registry
+	// 保护clients和closed
+	clientMutex sync.Mutex
+	clients     map[string]*watchedClient
+	closed      bool
 }
 
 func (sc *Scheduler) GetServerOptions() *erpc.ServerOptions {
 	so := new(erpc.ServerOptions)
 	so.Address = sc.ServerAddress
-	so.ServiceRegisterFunc = sc.GetServiceRegisterFunc()
-	so.Protocol = new(erpc.Protocol)
-	so.Protocol.Codec = new(protocol.JSONCodec)
-	so.Protocol.Name = "json"
-	so.Protocol.Version = "1"
+	so.Advertise = sc.ServerAdvertise
+	so.Weight = sc.ServerWeight
+	so.Tags = sc.ServerTags
+	so.Meta = sc.ServerMeta
+	so.Registry = sc.getRegistry()
+	so.Protocol = sc.getProtocol()
 	return so
 }
 
-func (c *Scheduler) GetServiceRegisterFunc() erpc.ServiceRegisterFunc {
-	return func(serviceName string) (err error) {
-		client := c.getConsulClient()
-		//创建一个新服务。
-		registration := new(consulapi.AgentServiceRegistration)
-		registration.ID = serviceName
-		registration.Name = serviceName
-		registration.Port = 9001
-		registration.Tags = []string{serviceName}
-		registration.Address = "10.211.55.2"
-
-		check := new(consulapi.AgentServiceCheck)
-		check.TCP = c.ServerAddress
-		check.Timeout = c.CheckTimeout
-		check.Interval = c.CheckInterval
-		registration.Check = check
-		return client.Agent().ServiceRegister(registration)
+// newProtocol 配置中server:protocol指定的协议，为空时使用json
+func (sc *Scheduler) newProtocol() (*erpc.Protocol, error) {
+	name := sc.Protocol
+	if name == "" {
+		name = "json"
 	}
+	return erpc.NewProtocol(name, "1")
 }
 
-func (scheduler *Scheduler) getConsulClient() *consulapi.Client {
-	config := consulapi.DefaultConfig()
-	config.Address = scheduler.ConsulAddress
-	client, err := consulapi.NewClient(config)
-	if err == nil {
-		return client
+// getProtocol 客户端和服务端默认使用相同的协议
+func (sc *Scheduler) getProtocol() *erpc.Protocol {
+	p, err := sc.newProtocol()
+	if err != nil {
+		erpc.Warn("%s, 使用json协议", err.Error())
+		p, _ = erpc.NewProtocol("json", "1")
 	}
+	return p
+}
 
-	return nil
+// getRegistry 配置中consul:address对应的注册中心，服务端和客户端共用一个
+func (sc *Scheduler) getRegistry() *Registry {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if sc.registry != nil {
+		return sc.registry
+	}
+	registry, err := NewRegistry(sc.ConsulAddress)
+	if err != nil {
+		panic(err)
+	}
+	registry.CheckTimeout = sc.CheckTimeout
+	registry.CheckInterval = sc.CheckInterval
+	registry.CheckTTL = sc.CheckTTL
+	registry.DeregisterAfter = sc.CheckDeregisterAfter
+	sc.registry = registry
+	return registry
+}
+
+// watchedClient 监听服务实例变化的客户端
+type watchedClient struct {
+	client *erpc.BalancedClient
+	cancel context.CancelFunc
 }
 
-func (scheduler *Scheduler) GetClient(serviceName string) (c *erpc.Client, err error) {
-	client := scheduler.getConsulClient()
-	q := new(consulapi.QueryOptions)
-	r, _, _ := client.Health().Service(serviceName, "", true, q)
-	if len(r) != 1 {
-		return nil, errors.New("no service found")
+// close 停止监听并关闭客户端
+func (wc *watchedClient) close() {
+	wc.cancel()
+	wc.client.Close()
+}
+
+// GetClient 连接服务所有健康的实例，按配置的负载均衡策略选择实例；
+// 客户端会被缓存，并通过consul的阻塞查询跟随实例的变化，Close时关闭
+func (scheduler *Scheduler) GetClient(serviceName string) (*erpc.BalancedClient, error) {
+	if c, ok, err := scheduler.cachedClient(serviceName); ok || err != nil {
+		return c, err
+	}
+	// 建立连接比较慢，不持有锁，避免阻塞其它服务的GetClient
+	wc, err := scheduler.newClient(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	scheduler.clientMutex.Lock()
+	defer scheduler.clientMutex.Unlock()
+	if scheduler.closed {
+		wc.close()
+		return nil, erpc.ErrClientClosed
+	}
+	// 同时有其它GetClient建立了客户端时使用先缓存的那个
+	if old, ok := scheduler.clients[serviceName]; ok {
+		wc.close()
+		return old.client, nil
+	}
+	if scheduler.clients == nil {
+		scheduler.clients = make(map[string]*watchedClient)
+	}
+	scheduler.clients[serviceName] = wc
+	return wc.client, nil
+}
+
+// cachedClient 查找缓存的客户端
+func (scheduler *Scheduler) cachedClient(serviceName string) (*erpc.BalancedClient, bool, error) {
+	scheduler.clientMutex.Lock()
+	defer scheduler.clientMutex.Unlock()
+	if scheduler.closed {
+		return nil, false, erpc.ErrClientClosed
+	}
+	if wc, ok := scheduler.clients[serviceName]; ok {
+		return wc.client, true, nil
+	}
+	return nil, false, nil
+}
+
+// newClient 建立服务的客户端并开始监听实例的变化
+func (scheduler *Scheduler) newClient(serviceName string) (*watchedClient, error) {
+	registry := scheduler.getRegistry()
+	balancer, err := erpc.NewBalancer(scheduler.Balancer)
+	if err != nil {
+		return nil, err
 	}
 	co := new(erpc.ClientOptions)
-	co.Address = r[0].Service.Address + ":" + strconv.Itoa(r[0].Service.Port)
 	co.Timeout = 3
-	co.Protocol = new(erpc.Protocol)
-	co.Protocol.Codec = new(protocol.JSONCodec)
-	co.Protocol.Name = "json"
-	return erpc.NewClient(co)
+	co.Protocol = scheduler.getProtocol()
+	// 和服务端协商协议，服务端还没有切换到配置的协议时使用json
+	co.Protocols = []*erpc.Protocol{co.Protocol}
+	if co.Protocol.Name != "json" {
+		co.Protocols = append(co.Protocols, &erpc.Protocol{Name: "json", Version: "1"})
+	}
+	c, err := erpc.NewBalancedClient(serviceName, registry, balancer, co)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := registry.Watch(ctx, serviceName)
+	if err != nil {
+		cancel()
+		c.Close()
+		return nil, err
+	}
+	go func() {
+		for instances := range ch {
+			if err := c.Update(instances); err != nil {
+				erpc.Warn("更新服务 %s 的实例失败: %s", serviceName, err.Error())
+			}
+		}
+	}()
+	return &watchedClient{client: c, cancel: cancel}, nil
 }
 
+// Call 用缓存的客户端调用服务的方法
 func (scheduler *Scheduler) Call(serviceName string, methodName string, params ...interface{}) (resp erpc.Response, err error) {
 	client, err := scheduler.GetClient(serviceName)
 	if err != nil {
@@ -97,3 +210,16 @@ func (scheduler *Scheduler) Call(serviceName string, methodName string, params .
 	}
 	return client.Call(serviceName, methodName, params)
 }
+
+// Close 停止监听并关闭所有缓存的客户端
+func (scheduler *Scheduler) Close() error {
+	scheduler.clientMutex.Lock()
+	clients := scheduler.clients
+	scheduler.clients = nil
+	scheduler.closed = true
+	scheduler.clientMutex.Unlock()
+	for _, wc := range clients {
+		wc.close()
+	}
+	return nil
+}
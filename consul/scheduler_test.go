@@ -0,0 +1,178 @@
+package consul_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/euphie/erpc"
+	"github.com/euphie/erpc/consul"
+	"github.com/euphie/erpc/internal/testutil"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// fakeConsul 模拟consul的/v1/health/service/<name>，支持阻塞查询
+type fakeConsul struct {
+	mutex   sync.Mutex
+	index   uint64
+	status  int
+	entries []*consulapi.ServiceEntry
+	// 实例变化时关闭，唤醒阻塞查询
+	changed chan struct{}
+	// 收到的阻塞查询的索引
+	waits []uint64
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{status: http.StatusOK, entries: []*consulapi.ServiceEntry{}, changed: make(chan struct{})}
+}
+
+// set 更新实例列表和响应码，索引加一
+func (f *fakeConsul) set(status int, addresses ...string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.index++
+	f.status = status
+	f.entries = f.entries[:0:0]
+	for _, address := range addresses {
+		host, port, _ := net.SplitHostPort(address)
+		p, _ := strconv.Atoi(port)
+		f.entries = append(f.entries, &consulapi.ServiceEntry{
+			Node: &consulapi.Node{Node: "node", Address: host},
+			Service: &consulapi.AgentService{
+				ID:      "Who-" + address,
+				Service: "Who",
+				Address: host,
+				Port:    p,
+				Weights: consulapi.AgentWeights{Passing: 1, Warning: 1},
+			},
+		})
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// waited 是否收到过索引为index的阻塞查询
+func (f *fakeConsul) waited(index uint64) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, i := range f.waits {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/Who" {
+		http.NotFound(w, r)
+		return
+	}
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	f.mutex.Lock()
+	if index > 0 {
+		f.waits = append(f.waits, index)
+	}
+	// 阻塞查询：索引没有变化时等待
+	for index > 0 && index == f.index {
+		changed := f.changed
+		f.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		f.mutex.Lock()
+	}
+	status, entries, last := f.status, f.entries, f.index
+	f.mutex.Unlock()
+	if status != http.StatusOK {
+		http.Error(w, "consul不可用", status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(last, 10))
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func TestSchedulerWatch(t *testing.T) {
+	fake := newFakeConsul()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	address := strings.TrimPrefix(srv.URL, "http://")
+
+	a, b := testutil.Serve(t, 1, nil), testutil.Serve(t, 2, nil)
+	fake.set(http.StatusOK, a, b)
+
+	file := filepath.Join(t.TempDir(), "erpc.conf")
+	if err := os.WriteFile(file, []byte("[consul]\naddress "+address+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	scheduler := consul.NewScheduler(file)
+	defer scheduler.Close()
+	bc, err := scheduler.GetClient("Who")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var removed *erpc.Client
+	for _, node := range bc.Nodes() {
+		if node.Instance.Address == b {
+			removed = node.Client
+		}
+	}
+	if len(bc.Nodes()) != 2 || removed == nil {
+		t.Fatalf("节点错误: %v", bc.Nodes())
+	}
+	if cached, _ := scheduler.GetClient("Who"); cached != bc {
+		t.Fatal("客户端没有被缓存")
+	}
+
+	// 监听用上一次的索引发起阻塞查询，实例消失后关闭它的客户端
+	testutil.Eventually(t, "阻塞查询", func() bool { return fake.waited(1) })
+	fake.set(http.StatusOK, a)
+	testutil.Eventually(t, "实例消失", func() bool { return len(bc.Nodes()) == 1 })
+	if err := removed.CallInto(context.Background(), "Who", "Who", new(int)); !errors.Is(err, erpc.ErrClientClosed) {
+		t.Fatalf("消失的实例的客户端没有关闭: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		var id int
+		if err := bc.CallInto(context.Background(), "Who", "Who", &id); err != nil || id != 1 {
+			t.Fatalf("请求分配错误: %d %v", id, err)
+		}
+	}
+	testutil.Eventually(t, "新索引的阻塞查询", func() bool { return fake.waited(2) })
+
+	// consul返回5xx时使用最后一次查询到的实例
+	registry, err := consul.NewRegistry(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instances, err := registry.Resolve("Who"); err != nil || len(instances) != 1 {
+		t.Fatalf("查询实例失败: %v %v", instances, err)
+	}
+	fake.set(http.StatusInternalServerError)
+	instances, err := registry.Resolve("Who")
+	if err != nil || len(instances) != 1 || instances[0].Address != a {
+		t.Fatalf("5xx时没有使用最后一次查询到的实例: %v %v", instances, err)
+	}
+	fresh, _ := consul.NewRegistry(address)
+	if _, err := fresh.Resolve("Who"); err == nil {
+		t.Fatal("没有查询成功过时应该返回错误")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(bc.Nodes()) != 1 {
+		t.Fatalf("5xx时节点被清空: %v", bc.Nodes())
+	}
+}
@@ -0,0 +1,141 @@
+package erpc
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// contextKey context中使用的key类型
+type contextKey int
+
+const (
+	connInfoKey contextKey = iota
+	requestInfoKey
+	metadataKey
+	responseMetadataKey
+)
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// ConnInfo 连接信息
+type ConnInfo struct {
+	// 本地地址
+	LocalAddr net.Addr
+	// 客户端地址
+	RemoteAddr net.Addr
+}
+
+// RequestInfo 请求信息
+type RequestInfo struct {
+	// 请求序列
+	Seq uint64
+	// 服务名称
+	ServiceName string
+	// 方法名称
+	MethodName string
+}
+
+// Metadata 请求和响应携带的元数据，例如trace id、认证信息、调用方标识
+type Metadata map[string]string
+
+// Copy 复制一份元数据
+func (md Metadata) Copy() Metadata {
+	c := make(Metadata, len(md))
+	for k, v := range md {
+		c[k] = v
+	}
+	return c
+}
+
+// WithMetadata 在ctx中添加元数据，客户端用这个ctx调用时随请求发送。
+// 服务端方法收到的ctx中带有请求的元数据，用它继续调用其它服务时元数据会沿调用链传递
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	merged := MetadataFromContext(ctx).Copy()
+	for k, v := range md {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, metadataKey, merged)
+}
+
+// MetadataFromContext 获取ctx中的元数据，不要修改返回的Metadata
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey).(Metadata)
+	return md
+}
+
+// responseMetadata 服务端方法设置的响应元数据
+type responseMetadata struct {
+	sync.Mutex
+	md Metadata
+}
+
+// SetResponseMetadata 服务端方法设置随响应返回的元数据
+func SetResponseMetadata(ctx context.Context, key string, value string) {
+	rmd, ok := ctx.Value(responseMetadataKey).(*responseMetadata)
+	if !ok {
+		return
+	}
+	rmd.Lock()
+	defer rmd.Unlock()
+	if rmd.md == nil {
+		rmd.md = make(Metadata)
+	}
+	rmd.md[key] = value
+}
+
+// mergeResponseMetadata 把方法设置的元数据合并到响应中，响应中已有的key优先
+func mergeResponseMetadata(ctx context.Context, resp *Response) {
+	rmd, ok := ctx.Value(responseMetadataKey).(*responseMetadata)
+	if !ok {
+		return
+	}
+	rmd.Lock()
+	defer rmd.Unlock()
+	if len(rmd.md) == 0 {
+		return
+	}
+	if resp.Metadata == nil {
+		resp.Metadata = make(Metadata, len(rmd.md))
+	}
+	for k, v := range rmd.md {
+		if _, ok := resp.Metadata[k]; !ok {
+			resp.Metadata[k] = v
+		}
+	}
+}
+
+// ConnInfoFromContext 获取context中的连接信息
+func ConnInfoFromContext(ctx context.Context) (info *ConnInfo, ok bool) {
+	info, ok = ctx.Value(connInfoKey).(*ConnInfo)
+	return
+}
+
+// RequestInfoFromContext 获取context中的请求信息
+func RequestInfoFromContext(ctx context.Context) (info *RequestInfo, ok bool) {
+	info, ok = ctx.Value(requestInfoKey).(*RequestInfo)
+	return
+}
+
+// newServerContext 根据请求生成方法调用使用的context
+func newServerContext(conn net.Conn, req *Request) (ctx context.Context, cancel context.CancelFunc) {
+	ctx = context.WithValue(context.Background(), connInfoKey, &ConnInfo{
+		LocalAddr:  conn.LocalAddr(),
+		RemoteAddr: conn.RemoteAddr(),
+	})
+	ctx = context.WithValue(ctx, requestInfoKey, &RequestInfo{
+		Seq:         req.Seq,
+		ServiceName: req.ServiceName,
+		MethodName:  req.MethodName,
+	})
+	if req.Metadata != nil {
+		ctx = context.WithValue(ctx, metadataKey, req.Metadata)
+	}
+	ctx = context.WithValue(ctx, responseMetadataKey, new(responseMetadata))
+	if req.Deadline > 0 {
+		return context.WithDeadline(ctx, time.Unix(0, req.Deadline))
+	}
+	return context.WithCancel(ctx)
+}
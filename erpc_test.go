@@ -0,0 +1,117 @@
+package erpc_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/euphie/erpc"
+	"github.com/euphie/erpc/internal/testutil"
+)
+
+// testService 测试用的服务
+type testService struct {
+	// Wait的ctx被取消时写入
+	canceled chan struct{}
+	// Count已经发送的消息数
+	sent int32
+}
+
+func newTestService() *testService {
+	return &testService{canceled: make(chan struct{}, 10)}
+}
+
+func (s *testService) Echo(text string) (string, error) {
+	return text, nil
+}
+
+// Wait 等待ms毫秒，ctx被取消时立即返回
+func (s *testService) Wait(ctx context.Context, ms int) (int, error) {
+	select {
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+		return ms, nil
+	case <-ctx.Done():
+		s.canceled <- struct{}{}
+		return 0, ctx.Err()
+	}
+}
+
+// Count 依次发送0到n-1
+func (s *testService) Count(n int, stream *erpc.ServerStream) error {
+	for i := 0; i < n; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+		atomic.AddInt32(&s.sent, 1)
+	}
+	return nil
+}
+
+// Chat 把收到的消息原样发回
+func (s *testService) Chat(stream *erpc.ServerStream) error {
+	for {
+		var text string
+		if err := stream.Recv(&text); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := stream.Send(text); err != nil {
+			return err
+		}
+	}
+}
+
+// newTestServer 创建注册了testService的服务器，测试结束时关闭
+func newTestServer(t *testing.T, service *testService, options *erpc.ServerOptions) *erpc.Server {
+	if options == nil {
+		options = new(erpc.ServerOptions)
+	}
+	options.Protocol = testutil.Protocol()
+	server := erpc.NewServer(options)
+	server.Register(service, "Test")
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+// listen 在随机端口上启动服务器，返回监听的地址
+func listen(t *testing.T, server *erpc.Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	return listener.Addr().String()
+}
+
+// pipeDial 用net.Pipe连接服务器，每次建立连接时把服务端一侧交给conns
+func pipeDial(server *erpc.Server, conns chan<- net.Conn) func(string) (net.Conn, error) {
+	return func(string) (net.Conn, error) {
+		a, b := net.Pipe()
+		if conns != nil {
+			conns <- b
+		}
+		go server.ServeConn(b)
+		return a, nil
+	}
+}
+
+// newTestClient 创建客户端，测试结束时关闭
+func newTestClient(t *testing.T, options *erpc.ClientOptions) *erpc.Client {
+	if options.Protocol == nil {
+		options.Protocol = testutil.Protocol()
+	}
+	if options.Timeout == 0 {
+		options.Timeout = 5
+	}
+	client, err := erpc.NewClient(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
@@ -0,0 +1,121 @@
+package erpc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorCode 错误码，失败响应的Response.Code就是错误码，都是负数
+type ErrorCode int
+
+const (
+	// CodeOK 成功，返回(T, error)或error的方法调用成功时的响应码
+	CodeOK ErrorCode = 0
+	// CodeInternal 服务端内部错误，例如方法调用发生panic
+	CodeInternal ErrorCode = -10000
+	// CodeDeadlineExceeded 超过了请求的截止时间
+	CodeDeadlineExceeded ErrorCode = -10001
+	// CodeUnknown 方法返回了不是*RPCError的error
+	CodeUnknown ErrorCode = -10002
+	// CodeInvalidArgument 参数错误
+	CodeInvalidArgument ErrorCode = -10003
+	// CodeCanceled 客户端取消了请求
+	CodeCanceled ErrorCode = -10004
+	// CodeNotFound 服务、方法或者资源不存在
+	CodeNotFound ErrorCode = -10005
+	// CodeUnavailable 连接断开、服务器关闭等暂时不可用的情况，可以重试
+	CodeUnavailable ErrorCode = -10006
+	// CodeUnauthenticated 没有认证
+	CodeUnauthenticated ErrorCode = -10007
+	// CodePermissionDenied 没有权限
+	CodePermissionDenied ErrorCode = -10008
+	// CodeResourceExhausted 资源耗尽，例如被限流，可以稍后重试
+	CodeResourceExhausted ErrorCode = -10009
+	// CodeUnimplemented 方法没有实现
+	CodeUnimplemented ErrorCode = -10010
+)
+
+var codeNames = map[ErrorCode]string{
+	CodeOK:                "OK",
+	CodeInternal:          "Internal",
+	CodeDeadlineExceeded:  "DeadlineExceeded",
+	CodeUnknown:           "Unknown",
+	CodeInvalidArgument:   "InvalidArgument",
+	CodeCanceled:          "Canceled",
+	CodeNotFound:          "NotFound",
+	CodeUnavailable:       "Unavailable",
+	CodeUnauthenticated:   "Unauthenticated",
+	CodePermissionDenied:  "PermissionDenied",
+	CodeResourceExhausted: "ResourceExhausted",
+	CodeUnimplemented:     "Unimplemented",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Code(%d)", int(c))
+}
+
+// Retryable 是否可以重试
+func (c ErrorCode) Retryable() bool {
+	return c == CodeUnavailable || c == CodeResourceExhausted
+}
+
+// RPCError RPC错误，服务端通过响应返回，客户端用errors.As取出后根据Code判断
+type RPCError struct {
+	Code    ErrorCode
+	Message string
+	// 客户端本地产生的错误的原因，不会在网络上传输
+	cause error
+}
+
+// NewError 生成一个错误，服务端方法可以直接返回它来指定错误码
+func NewError(code ErrorCode, format string, a ...interface{}) *RPCError {
+	return &RPCError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// wrapError 用错误码包装一个本地错误，已经是*RPCError时原样返回
+func wrapError(code ErrorCode, err error) *RPCError {
+	if e, ok := err.(*RPCError); ok {
+		return e
+	}
+	return &RPCError{Code: code, Message: err.Error(), cause: err}
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s(%d): %s", e.Code, int(e.Code), e.Message)
+}
+
+// Unwrap Unwrap
+func (e *RPCError) Unwrap() error {
+	return e.cause
+}
+
+// Retryable 是否可以重试
+func (e *RPCError) Retryable() bool {
+	return e.Code.Retryable()
+}
+
+// toError 把任意error转换成*RPCError，不是*RPCError时使用CodeUnknown
+func toError(err error) *RPCError {
+	var e *RPCError
+	if errors.As(err, &e) {
+		return e
+	}
+	return wrapError(CodeUnknown, err)
+}
+
+// errorResponse 失败响应
+func errorResponse(err error) Response {
+	e := toError(err)
+	return Response{Code: int(e.Code), Message: e.Message}
+}
+
+// Code 获取error的错误码，nil返回CodeOK，不是*RPCError时返回CodeUnknown
+func Code(err error) ErrorCode {
+	if err == nil {
+		return CodeOK
+	}
+	return toError(err).Code
+}
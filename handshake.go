@@ -0,0 +1,132 @@
+package erpc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+//=============协议协商=================
+// 客户端连接后发送一行文本，按优先顺序列出支持的协议：
+//   ERPC json/1,msgpack/1\n
+// 服务端选中第一个自己支持的协议并回复：
+//   OK msgpack/1\n
+// 没有可用的协议时回复 ERR 原因\n 并关闭连接。
+// 不发送握手的客户端使用服务端默认的协议。
+
+const (
+	handshakePrefix = "ERPC "
+	// 握手的超时时间
+	handshakeTimeout = 10 * time.Second
+	// 握手消息的最大长度
+	maxHandshakeLength = 1024
+)
+
+// bufferedConn 握手时预读过数据的连接
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// wait 等到连接上有数据可读
+func (c *bufferedConn) wait() error {
+	_, err := c.r.Peek(1)
+	return err
+}
+
+// readLine 读取握手消息
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > maxHandshakeLength {
+		return "", errors.New("握手消息太长")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(line)), nil
+}
+
+// clientHandshake 客户端发送支持的协议，返回服务端选中的协议
+func clientHandshake(conn net.Conn, protocols []*Protocol) (net.Conn, *Protocol, error) {
+	keys := make([]string, len(protocols))
+	for i, p := range protocols {
+		keys[i] = protocolKey(p.Name, p.Version)
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte(handshakePrefix + strings.Join(keys, ",") + "\n")); err != nil {
+		return nil, nil, fmt.Errorf("发送握手消息失败: %s", err.Error())
+	}
+	r := bufio.NewReader(conn)
+	line, err := readLine(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取握手消息失败: %s", err.Error())
+	}
+	if strings.HasPrefix(line, "ERR ") {
+		return nil, nil, fmt.Errorf("协议协商失败: %s", line[4:])
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return nil, nil, errors.New("握手消息格式错误")
+	}
+	key := line[3:]
+	for i, p := range protocols {
+		if keys[i] != key {
+			continue
+		}
+		if p.Codec == nil {
+			if p, err = NewProtocol(p.Name, p.Version); err != nil {
+				return nil, nil, err
+			}
+		}
+		return &bufferedConn{Conn: conn, r: r}, p, nil
+	}
+	return nil, nil, fmt.Errorf("服务端选择了不支持的协议: %s", key)
+}
+
+// serverHandshake 客户端发送了握手消息时选择协议，否则使用默认协议；
+// 不握手的客户端连接后可能很久才发送第一个请求，所以收到第一个字节之后才开始计算握手的超时时间
+func serverHandshake(conn net.Conn, def *Protocol) (*bufferedConn, *Protocol, error) {
+	r := bufio.NewReader(conn)
+	bconn := &bufferedConn{Conn: conn, r: r}
+	if err := bconn.wait(); err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	prefix, err := r.Peek(len(handshakePrefix))
+	if err != nil || string(prefix) != handshakePrefix {
+		// 读取失败时交给编码器处理
+		return bconn, def, nil
+	}
+	line, err := readLine(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取握手消息失败: %s", err.Error())
+	}
+	list := strings.TrimPrefix(line, strings.TrimSpace(handshakePrefix))
+	for _, key := range strings.Split(list, ",") {
+		key = strings.TrimSpace(key)
+		p := def
+		if key != protocolKey(def.Name, def.Version) {
+			i := strings.LastIndex(key, "/")
+			if i < 0 {
+				continue
+			}
+			if p, err = NewProtocol(key[:i], key[i+1:]); err != nil {
+				continue
+			}
+		}
+		if _, err = conn.Write([]byte("OK " + key + "\n")); err != nil {
+			return nil, nil, fmt.Errorf("发送握手消息失败: %s", err.Error())
+		}
+		return bconn, p, nil
+	}
+	conn.Write([]byte("ERR 没有支持的协议\n"))
+	return nil, nil, fmt.Errorf("没有支持的协议: %s", line)
+}
@@ -0,0 +1,41 @@
+package erpc
+
+import (
+	"context"
+)
+
+// Handler 服务端的方法调用，params是解码后的参数，不包括context.Context
+type Handler func(ctx context.Context, params []interface{}) Response
+
+// ServerInterceptor 服务端拦截器，调用handler继续执行后面的拦截器和方法，
+// 可以修改ctx和params，也可以不调用handler直接返回响应
+type ServerInterceptor func(ctx context.Context, info *RequestInfo, params []interface{}, handler Handler) Response
+
+// Invoker 客户端发送请求并等待响应，params是编码前的参数
+type Invoker func(ctx context.Context, params []interface{}) (Response, error)
+
+// ClientInterceptor 客户端拦截器，调用invoker继续执行后面的拦截器和请求，
+// info中的Seq在客户端总是0
+type ClientInterceptor func(ctx context.Context, info *RequestInfo, params []interface{}, invoker Invoker) (Response, error)
+
+// chainServerInterceptors 把拦截器串成一个Handler，第一个拦截器在最外层
+func chainServerInterceptors(interceptors []ServerInterceptor, info *RequestInfo, handler Handler) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, params []interface{}) Response {
+			return interceptor(ctx, info, params, next)
+		}
+	}
+	return handler
+}
+
+// chainClientInterceptors 把拦截器串成一个Invoker，第一个拦截器在最外层
+func chainClientInterceptors(interceptors []ClientInterceptor, info *RequestInfo, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, params []interface{}) (Response, error) {
+			return interceptor(ctx, info, params, next)
+		}
+	}
+	return invoker
+}
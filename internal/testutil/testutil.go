@@ -0,0 +1,95 @@
+// Package testutil 各个包的测试共用的服务和辅助函数，导入后不再输出日志
+package testutil
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/euphie/erpc"
+	_ "github.com/euphie/erpc/protocol"
+)
+
+func init() {
+	erpc.SetLogLevel(erpc.NONE)
+}
+
+// WhoService 返回服务器的编号，用来区分请求落到了哪个实例
+type WhoService struct {
+	ID int
+}
+
+// Who 返回服务器的编号
+func (s *WhoService) Who() (int, error) {
+	return s.ID, nil
+}
+
+// Protocol 测试使用的JSON协议
+func Protocol() *erpc.Protocol {
+	protocol, _ := erpc.NewProtocol("json", "1")
+	return protocol
+}
+
+// NewServer 创建注册了WhoService的服务器，reg不为空时开始监听后登记实例，测试结束时关闭
+func NewServer(t testing.TB, id int, reg erpc.Registry) *erpc.Server {
+	server := erpc.NewServer(&erpc.ServerOptions{Protocol: Protocol(), Registry: reg})
+	server.Register(&WhoService{id}, "Who")
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+// Serve 在随机端口上启动NewServer创建的服务器，返回监听的地址
+func Serve(t testing.TB, id int, reg erpc.Registry) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewServer(t, id, reg).Serve(listener)
+	return listener.Addr().String()
+}
+
+// ClientOptions 连接测试服务器的客户端选项
+func ClientOptions() *erpc.ClientOptions {
+	return &erpc.ClientOptions{Protocol: Protocol(), Timeout: 2, ReconnectInterval: 10 * time.Millisecond}
+}
+
+// Eventually 等待ok返回true，超过3秒时测试失败
+func Eventually(t testing.TB, what string, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待超时: %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// WaitInstances 等待注册中心中有n个Who的实例，Serve开始监听后才登记
+func WaitInstances(t testing.TB, r erpc.Resolver, n int) []erpc.Instance {
+	t.Helper()
+	var instances []erpc.Instance
+	Eventually(t, "登记实例", func() bool {
+		var err error
+		if instances, err = r.Resolve("Who"); err != nil {
+			t.Fatal(err)
+		}
+		return len(instances) == n
+	})
+	return instances
+}
+
+// Collect 调用n次Who，返回请求落到的实例
+func Collect(t testing.TB, bc *erpc.BalancedClient, n int) map[int]bool {
+	t.Helper()
+	seen := make(map[int]bool)
+	for i := 0; i < n; i++ {
+		var id int
+		if err := bc.CallInto(context.Background(), "Who", "Who", &id); err != nil {
+			t.Fatal(err)
+		}
+		seen[id] = true
+	}
+	return seen
+}
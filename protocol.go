@@ -1,11 +1,11 @@
 package erpc
 
 import (
-	"errors"
 	"fmt"
 	"net"
 	"reflect"
 	"strconv"
+	"time"
 )
 
 // ParamTypes 参数类型映射
@@ -30,7 +30,7 @@ func (param RequestParam) GetValue() (value interface{}) {
 		temp, _ := strconv.ParseInt(param.Value, 10, 32)
 		value = int32(temp)
 	case "int64":
-		temp, _ := strconv.ParseInt(param.Value, 10, 32)
+		temp, _ := strconv.ParseInt(param.Value, 10, 64)
 		value = int64(temp)
 	case "float32":
 		temp, _ := strconv.ParseFloat(param.Value, 32)
@@ -47,8 +47,24 @@ func (param RequestParam) GetValue() (value interface{}) {
 	return
 }
 
-// GetRequestParam 参数转换成RequestParam
-func GetRequestParam(value interface{}) (RequestParam, error) {
+// Decode 按方法参数的类型还原参数值，复合类型的参数用编码器解码
+func (param RequestParam) Decode(codec Codec, t reflect.Type) (value reflect.Value, err error) {
+	if _, ok := ParamTypes[param.Type]; ok {
+		value = reflect.ValueOf(param.GetValue())
+		if !value.Type().AssignableTo(t) {
+			return value, NewError(CodeInvalidArgument, "参数类型不匹配: 需要%s, 实际为%s", t, param.Type)
+		}
+		return value, nil
+	}
+	ptr := reflect.New(t)
+	if err = codec.Unmarshal([]byte(param.Value), ptr.Interface()); err != nil {
+		return value, NewError(CodeInvalidArgument, "参数解析失败: %s", err.Error())
+	}
+	return ptr.Elem(), nil
+}
+
+// GetRequestParam 参数转换成RequestParam，复合类型的参数用编码器编码
+func GetRequestParam(value interface{}, codec Codec) (RequestParam, error) {
 	rp := new(RequestParam)
 	switch value.(type) {
 	case int:
@@ -73,14 +89,54 @@ func GetRequestParam(value interface{}) (RequestParam, error) {
 		rp.Type = "bool"
 		rp.Value = fmt.Sprint(value.(bool))
 	default:
-		return *rp, errors.New("不支持的参数类型")
+		if value == nil {
+			return *rp, NewError(CodeInvalidArgument, "不支持的参数类型")
+		}
+		rp.Type = compositeType(reflect.TypeOf(value))
+		if rp.Type == "" {
+			return *rp, NewError(CodeInvalidArgument, "不支持的参数类型")
+		}
+		data, err := codec.Marshal(value)
+		if err != nil {
+			return *rp, NewError(CodeInvalidArgument, "参数编码失败: %s", err.Error())
+		}
+		rp.Value = string(data)
 	}
 	return *rp, nil
 }
 
+var timeType = reflect.TypeOf(time.Time{})
+
+// compositeType 复合参数类型，不支持的类型返回空字符串
+func compositeType(t reflect.Type) string {
+	if t == timeType {
+		return "time"
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		return "struct"
+	case reflect.Ptr:
+		if t.Elem().Kind() == reflect.Struct {
+			return "ptr"
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes"
+		}
+		return "slice"
+	case reflect.Map:
+		if t.Key().Kind() == reflect.String {
+			return "map"
+		}
+	}
+	return ""
+}
+
 func checkIn(intype reflect.Type) bool {
-	_, ok := ParamTypes[intype.String()]
-	return ok
+	if _, ok := ParamTypes[intype.String()]; ok {
+		return true
+	}
+	return compositeType(intype) != ""
 }
 
 func convert(param *RequestParam) (value interface{}) {
@@ -115,10 +171,38 @@ type Codec interface {
 	GetResponse(conn net.Conn) (resp Response, err error)
 	SendRequest(conn net.Conn, req Request) (err error)
 	SendResponse(conn net.Conn, resp Response) (err error)
+	// Marshal 按编码器的格式编码数据
+	Marshal(v interface{}) (data []byte, err error)
+	// Unmarshal 按编码器的格式把数据解码到v中，v必须是指针
+	Unmarshal(data []byte, v interface{}) (err error)
 }
 
+// MessageType 消息类型，用于在同一个连接上传输控制消息
+type MessageType uint8
+
+const (
+	// MessageCall 普通的请求或响应
+	MessageCall MessageType = iota
+	// MessageHeartbeat 心跳，服务端原样返回
+	MessageHeartbeat
+	// MessageCancel 客户端放弃了Seq对应的请求
+	MessageCancel
+	// MessageGoAway 服务端正在关闭，客户端不要在这个连接上发送新的请求
+	MessageGoAway
+	// MessageNotify 单向请求，服务端执行方法但不返回响应
+	MessageNotify
+	// MessageStream 流中的一个消息，服务端发送的流以Seq相同的普通响应结束
+	MessageStream
+	// MessageStreamEnd 客户端不再向流发送消息
+	MessageStreamEnd
+	// MessageWindow 接收方读取了Window个消息，发送方可以继续发送
+	MessageWindow
+)
+
 // Request 请求
 type Request struct {
+	// 消息类型
+	Type MessageType `json:"Type"`
 	// 请求序列，唯一
 	Seq uint64
 	// 服务名称
@@ -127,11 +211,34 @@ type Request struct {
 	MethodName string `json:"MethodName"`
 	// 请求参数
 	Params []RequestParam `json:"Params"`
+	// 截止时间(UnixNano)，0表示不限
+	Deadline int64 `json:"Deadline"`
+	// 元数据
+	Metadata Metadata `json:"Metadata"`
+	// 流控窗口增量，MessageWindow使用
+	Window uint32 `json:"Window,omitempty"`
+}
+
+// Failed 响应码是否表示调用失败；只有负数的响应码(ErrorCode)表示失败，
+// 0和正数的响应码由业务自行定义，例如Code为10000或404时Failed返回false
+func (resp Response) Failed() bool {
+	return resp.Code < 0
+}
+
+// Err 失败响应转换成*RPCError，成功时返回nil
+func (resp Response) Err() error {
+	if !resp.Failed() {
+		return nil
+	}
+	return &RPCError{Code: ErrorCode(resp.Code), Message: resp.Message}
 }
 
-// Response 响应，注册的方法返回值必须是Response类型
+// Response 响应，注册的方法可以直接返回Response，也可以返回(T, error)或者error，
+// 由服务端把T放到Data中，error转换成Code和Message
 type Response struct {
-	// 响应码
+	// 消息类型
+	Type MessageType
+	// 响应码，负数为框架的ErrorCode，表示调用失败；0和正数留给业务使用，框架不解释
 	Code int
 	// 响应消息
 	Message string
@@ -139,9 +246,14 @@ type Response struct {
 	Data interface{}
 	// 客户端过来的请求序列，原样返回
 	Seq uint64
+	// 元数据
+	Metadata Metadata
+	// 流控窗口增量，MessageWindow使用
+	Window uint32 `json:",omitempty"`
 }
 
-// RequestParam 方法参数
+// RequestParam 方法参数，Type为ParamTypes中的基础类型时Value是字符串形式的值，
+// 为struct、ptr、slice、map、bytes、time时Value是编码器编码后的数据
 type RequestParam struct {
 	Type  string
 	Value string
@@ -0,0 +1,289 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"github.com/euphie/erpc"
+)
+
+//=============二进制帧协议=================
+// 帧头固定17个字节，报文体长度为0时没有报文体：
+//   魔数(2) 版本号(1) 消息类型(1) 标志位(1) 请求序列(8) 报文体长度(4)
+// 多字节整数使用大端序
+
+// BinaryVersion 二进制帧协议的版本号
+const BinaryVersion = 1
+
+// 帧的消息类型
+const (
+	TypeRequest uint8 = iota + 1
+	TypeResponse
+	TypeHeartbeat
+	TypeCancel
+	TypeGoAway
+)
+
+// 帧的标志位
+const (
+	// FlagCompressed 报文体使用了gzip压缩
+	FlagCompressed uint8 = 1 << iota
+	// FlagOneWay 单向请求，不需要响应
+	FlagOneWay
+	// FlagError 失败的响应
+	FlagError
+)
+
+const (
+	headerLength = 17
+	// 默认的最大报文体长度
+	defaultMaxBodyLength = 16 * 1024 * 1024
+)
+
+var magic = [2]byte{0xE7, 0x52}
+
+// header 帧头
+type header struct {
+	Version uint8
+	Type    uint8
+	Flags   uint8
+	Seq     uint64
+	Length  uint32
+}
+
+// marshaler 报文体的编码方式
+type marshaler interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Framing 二进制帧的选项
+type Framing struct {
+	// 报文体超过该长度时使用gzip压缩，0表示不压缩
+	CompressThreshold int
+	// 允许的最大报文体长度，0表示使用默认值16MB
+	MaxBodyLength uint32
+}
+
+// readFrame 读取一帧
+func (f Framing) readFrame(conn io.Reader) (h header, body []byte, err error) {
+	buf := make([]byte, headerLength)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		if err != io.EOF {
+			err = errors.New("读取帧头错误")
+		}
+		return
+	}
+	if buf[0] != magic[0] || buf[1] != magic[1] {
+		err = errors.New("报文格式错误")
+		return
+	}
+	h.Version = buf[2]
+	if h.Version != BinaryVersion {
+		err = fmt.Errorf("协议版本不匹配: %d", h.Version)
+		return
+	}
+	h.Type = buf[3]
+	h.Flags = buf[4]
+	h.Seq = binary.BigEndian.Uint64(buf[5:13])
+	h.Length = binary.BigEndian.Uint32(buf[13:17])
+	max := f.MaxBodyLength
+	if max == 0 {
+		max = defaultMaxBodyLength
+	}
+	if h.Length > max {
+		err = fmt.Errorf("报文太大: %d", h.Length)
+		return
+	}
+	if h.Length == 0 {
+		return
+	}
+	body = make([]byte, h.Length)
+	if _, err = io.ReadFull(conn, body); err != nil {
+		err = errors.New("报文读取错误")
+		return
+	}
+	if h.Flags&FlagCompressed != 0 {
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(body)); err != nil {
+			err = errors.New("报文解压错误")
+			return
+		}
+		defer r.Close()
+		if body, err = ioutil.ReadAll(io.LimitReader(r, int64(max)+1)); err != nil || len(body) > int(max) {
+			err = errors.New("报文解压错误")
+			return
+		}
+	}
+	return
+}
+
+// writeFrame 写入一帧，帧头和报文体一次写入
+func (f Framing) writeFrame(conn io.Writer, h header, body []byte) (err error) {
+	if f.CompressThreshold > 0 && len(body) > f.CompressThreshold {
+		var zbuf bytes.Buffer
+		w := gzip.NewWriter(&zbuf)
+		if _, err = w.Write(body); err != nil {
+			return errors.New("报文压缩错误")
+		}
+		if err = w.Close(); err != nil {
+			return errors.New("报文压缩错误")
+		}
+		body = zbuf.Bytes()
+		h.Flags |= FlagCompressed
+	}
+	max := f.MaxBodyLength
+	if max == 0 {
+		max = defaultMaxBodyLength
+	}
+	if uint64(len(body)) > uint64(max) {
+		return errors.New("写入报文太大")
+	}
+	buf := make([]byte, headerLength, headerLength+len(body))
+	buf[0], buf[1] = magic[0], magic[1]
+	buf[2] = BinaryVersion
+	buf[3] = h.Type
+	buf[4] = h.Flags
+	binary.BigEndian.PutUint64(buf[5:13], h.Seq)
+	binary.BigEndian.PutUint32(buf[13:17], uint32(len(body)))
+	buf = append(buf, body...)
+	if _, err = conn.Write(buf); err != nil {
+		return errors.New("报文写入错误")
+	}
+	return nil
+}
+
+// getRequest 读取请求帧，报文体用m解码
+func (f Framing) getRequest(conn net.Conn, m marshaler) (req erpc.Request, err error) {
+	h, body, err := f.readFrame(conn)
+	if err != nil {
+		return
+	}
+	switch h.Type {
+	case TypeRequest:
+		if err = m.Unmarshal(body, &req); err != nil {
+			err = errors.New("报文解析错误")
+			return
+		}
+		if h.Flags&FlagOneWay != 0 {
+			req.Type = erpc.MessageNotify
+		}
+	case TypeHeartbeat:
+		req.Type = erpc.MessageHeartbeat
+	case TypeCancel:
+		req.Type = erpc.MessageCancel
+	default:
+		err = fmt.Errorf("不支持的消息类型: %d", h.Type)
+		return
+	}
+	req.Seq = h.Seq
+	return
+}
+
+// getResponse 读取响应帧，报文体用m解码
+func (f Framing) getResponse(conn net.Conn, m marshaler) (resp erpc.Response, err error) {
+	h, body, err := f.readFrame(conn)
+	if err != nil {
+		return
+	}
+	switch h.Type {
+	case TypeResponse:
+		if err = m.Unmarshal(body, &resp); err != nil {
+			err = errors.New("报文解析错误")
+			return
+		}
+	case TypeHeartbeat:
+		resp.Type = erpc.MessageHeartbeat
+	case TypeGoAway:
+		resp.Type = erpc.MessageGoAway
+	default:
+		err = fmt.Errorf("不支持的消息类型: %d", h.Type)
+		return
+	}
+	resp.Seq = h.Seq
+	return
+}
+
+// sendRequest 写入请求帧，报文体用m编码
+func (f Framing) sendRequest(conn net.Conn, m marshaler, req erpc.Request) (err error) {
+	h := header{Seq: req.Seq}
+	var body []byte
+	switch req.Type {
+	case erpc.MessageHeartbeat:
+		h.Type = TypeHeartbeat
+	case erpc.MessageCancel:
+		h.Type = TypeCancel
+	default:
+		h.Type = TypeRequest
+		if req.Type == erpc.MessageNotify {
+			h.Flags |= FlagOneWay
+		}
+		if body, err = m.Marshal(req); err != nil {
+			return errors.New("报文生成错误")
+		}
+	}
+	return f.writeFrame(conn, h, body)
+}
+
+// sendResponse 写入响应帧，报文体用m编码
+func (f Framing) sendResponse(conn net.Conn, m marshaler, resp erpc.Response) (err error) {
+	h := header{Seq: resp.Seq}
+	var body []byte
+	switch resp.Type {
+	case erpc.MessageHeartbeat:
+		h.Type = TypeHeartbeat
+	case erpc.MessageGoAway:
+		h.Type = TypeGoAway
+	default:
+		h.Type = TypeResponse
+		if resp.Failed() {
+			h.Flags |= FlagError
+		}
+		if body, err = m.Marshal(resp); err != nil {
+			return errors.New("报文生成错误")
+		}
+	}
+	return f.writeFrame(conn, h, body)
+}
+
+// BinaryCodec 二进制帧编码器，报文体使用JSON
+type BinaryCodec struct {
+	Framing
+}
+
+// GetRequest GetRequest
+func (bc *BinaryCodec) GetRequest(conn net.Conn) (req erpc.Request, err error) {
+	return bc.getRequest(conn, bc)
+}
+
+// GetResponse GetResponse
+func (bc *BinaryCodec) GetResponse(conn net.Conn) (resp erpc.Response, err error) {
+	return bc.getResponse(conn, bc)
+}
+
+// SendRequest SendRequest
+func (bc *BinaryCodec) SendRequest(conn net.Conn, req erpc.Request) (err error) {
+	return bc.sendRequest(conn, bc, req)
+}
+
+// SendResponse SendResponse
+func (bc *BinaryCodec) SendResponse(conn net.Conn, resp erpc.Response) (err error) {
+	return bc.sendResponse(conn, bc, resp)
+}
+
+// Marshal Marshal
+func (bc *BinaryCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal Unmarshal
+func (bc *BinaryCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
@@ -124,3 +124,13 @@ func (jc *JSONCodec) SendResponse(conn net.Conn, resp erpc.Response) (err error)
 	}
 	return err
 }
+
+// Marshal Marshal
+func (jc *JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal Unmarshal
+func (jc *JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
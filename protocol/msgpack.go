@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"net"
+
+	"github.com/euphie/erpc"
+	"github.com/vmihailenco/msgpack"
+)
+
+//=============MessagePack编码器=================
+
+// MsgpackCodec 使用二进制帧，报文体和复合类型的参数使用MessagePack编码
+type MsgpackCodec struct {
+	Framing
+}
+
+// GetRequest GetRequest
+func (mc *MsgpackCodec) GetRequest(conn net.Conn) (req erpc.Request, err error) {
+	return mc.getRequest(conn, mc)
+}
+
+// GetResponse GetResponse
+func (mc *MsgpackCodec) GetResponse(conn net.Conn) (resp erpc.Response, err error) {
+	return mc.getResponse(conn, mc)
+}
+
+// SendRequest SendRequest
+func (mc *MsgpackCodec) SendRequest(conn net.Conn, req erpc.Request) (err error) {
+	return mc.sendRequest(conn, mc, req)
+}
+
+// SendResponse SendResponse
+func (mc *MsgpackCodec) SendResponse(conn net.Conn, resp erpc.Response) (err error) {
+	return mc.sendResponse(conn, mc, resp)
+}
+
+// Marshal Marshal
+func (mc *MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// Unmarshal Unmarshal
+func (mc *MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
@@ -0,0 +1,336 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+
+	"github.com/euphie/erpc"
+	"github.com/golang/protobuf/proto"
+)
+
+//=============Protocol Buffers编码器=================
+// 报文体的结构见erpc.proto，参数和返回值可以是生成的proto.Message，
+// 其它复合类型的参数和返回值使用JSON编码
+
+// ProtoData 未解码的protobuf消息，客户端用CallInto解码到具体的消息类型
+type ProtoData []byte
+
+// ProtobufCodec 使用二进制帧，报文体使用Protocol Buffers编码
+type ProtobufCodec struct {
+	Framing
+}
+
+// GetRequest GetRequest
+func (pc *ProtobufCodec) GetRequest(conn net.Conn) (req erpc.Request, err error) {
+	return pc.getRequest(conn, pc)
+}
+
+// GetResponse GetResponse
+func (pc *ProtobufCodec) GetResponse(conn net.Conn) (resp erpc.Response, err error) {
+	return pc.getResponse(conn, pc)
+}
+
+// SendRequest SendRequest
+func (pc *ProtobufCodec) SendRequest(conn net.Conn, req erpc.Request) (err error) {
+	return pc.sendRequest(conn, pc, req)
+}
+
+// SendResponse SendResponse
+func (pc *ProtobufCodec) SendResponse(conn net.Conn, resp erpc.Response) (err error) {
+	return pc.sendResponse(conn, pc, resp)
+}
+
+// Marshal 请求和响应按erpc.proto编码，proto.Message用protobuf编码，其它类型用JSON编码
+func (pc *ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case erpc.Request:
+		return marshalRequest(&v)
+	case *erpc.Request:
+		return marshalRequest(v)
+	case erpc.Response:
+		return marshalResponse(&v)
+	case *erpc.Response:
+		return marshalResponse(v)
+	case ProtoData:
+		return v, nil
+	case proto.Message:
+		return proto.Marshal(v)
+	}
+	return json.Marshal(v)
+}
+
+// Unmarshal 和Marshal对应，v是proto.Message或者指向proto.Message的指针时用protobuf解码
+func (pc *ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *erpc.Request:
+		return unmarshalRequest(data, v)
+	case *erpc.Response:
+		return unmarshalResponse(data, v)
+	case proto.Message:
+		return proto.Unmarshal(data, v)
+	}
+	// 方法参数是*T时解码的目标是**T
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() && rv.Elem().Kind() == reflect.Ptr {
+		msg := reflect.New(rv.Elem().Type().Elem())
+		if pb, ok := msg.Interface().(proto.Message); ok {
+			if err := proto.Unmarshal(data, pb); err != nil {
+				return err
+			}
+			rv.Elem().Set(msg)
+			return nil
+		}
+	}
+	return json.Unmarshal(data, v)
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendVarint(b, uint64(field)<<3|wireVarint)
+	return appendVarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = appendVarint(b, uint64(field)<<3|wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// zigzag sint64的编码
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// field 解码出来的字段
+type field struct {
+	num    int
+	varint uint64
+	bytes  []byte
+}
+
+var errProtobuf = errors.New("protobuf报文格式错误")
+
+// readFields 解码消息中的字段，不认识的字段类型会被跳过
+func readFields(data []byte, fn func(f field) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtobuf
+		}
+		data = data[n:]
+		f := field{num: int(tag >> 3)}
+		switch tag & 7 {
+		case wireVarint:
+			if f.varint, n = binary.Uvarint(data); n <= 0 {
+				return errProtobuf
+			}
+			data = data[n:]
+		case wireBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return errProtobuf
+			}
+			f.bytes = data[n : n+int(l)]
+			data = data[n+int(l):]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errProtobuf
+			}
+			data = data[8:]
+			continue
+		case wireFixed32:
+			if len(data) < 4 {
+				return errProtobuf
+			}
+			data = data[4:]
+			continue
+		default:
+			return errProtobuf
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendMetadataField 编码map<string, string>，每个键值对是一个key=1、value=2的消息
+func appendMetadataField(b []byte, field int, md erpc.Metadata) []byte {
+	for k, v := range md {
+		var entry []byte
+		entry = appendBytesField(entry, 1, []byte(k))
+		entry = appendBytesField(entry, 2, []byte(v))
+		b = appendVarint(b, uint64(field)<<3|wireBytes)
+		b = appendVarint(b, uint64(len(entry)))
+		b = append(b, entry...)
+	}
+	return b
+}
+
+func readMetadataEntry(data []byte, md erpc.Metadata) error {
+	var k, v string
+	err := readFields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			k = string(f.bytes)
+		case 2:
+			v = string(f.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	md[k] = v
+	return nil
+}
+
+func marshalRequest(req *erpc.Request) ([]byte, error) {
+	var b []byte
+	b = appendVarintField(b, 1, uint64(req.Type))
+	b = appendVarintField(b, 2, req.Seq)
+	b = appendBytesField(b, 3, []byte(req.ServiceName))
+	b = appendBytesField(b, 4, []byte(req.MethodName))
+	for _, p := range req.Params {
+		var pb []byte
+		pb = appendBytesField(pb, 1, []byte(p.Type))
+		pb = appendBytesField(pb, 2, []byte(p.Value))
+		b = appendVarint(b, 5<<3|wireBytes)
+		b = appendVarint(b, uint64(len(pb)))
+		b = append(b, pb...)
+	}
+	b = appendVarintField(b, 6, uint64(req.Deadline))
+	b = appendMetadataField(b, 7, req.Metadata)
+	b = appendVarintField(b, 8, uint64(req.Window))
+	return b, nil
+}
+
+func unmarshalRequest(data []byte, req *erpc.Request) error {
+	return readFields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			req.Type = erpc.MessageType(f.varint)
+		case 2:
+			req.Seq = f.varint
+		case 3:
+			req.ServiceName = string(f.bytes)
+		case 4:
+			req.MethodName = string(f.bytes)
+		case 5:
+			var p erpc.RequestParam
+			err := readFields(f.bytes, func(f field) error {
+				switch f.num {
+				case 1:
+					p.Type = string(f.bytes)
+				case 2:
+					p.Value = string(f.bytes)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			req.Params = append(req.Params, p)
+		case 6:
+			req.Deadline = int64(f.varint)
+		case 7:
+			if req.Metadata == nil {
+				req.Metadata = make(erpc.Metadata)
+			}
+			return readMetadataEntry(f.bytes, req.Metadata)
+		case 8:
+			req.Window = uint32(f.varint)
+		}
+		return nil
+	})
+}
+
+func marshalResponse(resp *erpc.Response) (b []byte, err error) {
+	b = appendVarintField(b, 1, uint64(resp.Type))
+	b = appendVarintField(b, 2, zigzag(int64(resp.Code)))
+	b = appendBytesField(b, 3, []byte(resp.Message))
+	if resp.Data != nil {
+		var data []byte
+		dataType := "json"
+		switch v := resp.Data.(type) {
+		case ProtoData:
+			dataType, data = "proto", v
+		case proto.Message:
+			dataType = "proto"
+			data, err = proto.Marshal(v)
+		default:
+			data, err = json.Marshal(v)
+		}
+		if err != nil {
+			return
+		}
+		b = appendBytesField(b, 4, []byte(dataType))
+		b = appendBytesField(b, 5, data)
+	}
+	b = appendVarintField(b, 6, resp.Seq)
+	b = appendMetadataField(b, 7, resp.Metadata)
+	b = appendVarintField(b, 8, uint64(resp.Window))
+	return
+}
+
+func unmarshalResponse(data []byte, resp *erpc.Response) error {
+	var dataType string
+	var raw []byte
+	err := readFields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			resp.Type = erpc.MessageType(f.varint)
+		case 2:
+			resp.Code = int(unzigzag(f.varint))
+		case 3:
+			resp.Message = string(f.bytes)
+		case 4:
+			dataType = string(f.bytes)
+		case 5:
+			raw = f.bytes
+		case 6:
+			resp.Seq = f.varint
+		case 7:
+			if resp.Metadata == nil {
+				resp.Metadata = make(erpc.Metadata)
+			}
+			return readMetadataEntry(f.bytes, resp.Metadata)
+		case 8:
+			resp.Window = uint32(f.varint)
+		}
+		return nil
+	})
+	if err != nil || raw == nil {
+		return err
+	}
+	if dataType == "proto" {
+		resp.Data = ProtoData(append([]byte(nil), raw...))
+		return nil
+	}
+	return json.Unmarshal(raw, &resp.Data)
+}
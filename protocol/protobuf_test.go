@@ -0,0 +1,217 @@
+package protocol_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/euphie/erpc"
+	"github.com/euphie/erpc/protocol"
+	"github.com/golang/protobuf/proto"
+)
+
+// 测试用的消息，按protoc-gen-go的struct tag格式手写，避免依赖生成的代码
+
+type echoMsg struct {
+	Text  string `protobuf:"bytes,1,opt,name=text,proto3"`
+	Count int64  `protobuf:"varint,2,opt,name=count,proto3"`
+}
+
+func (m *echoMsg) Reset()         { *m = echoMsg{} }
+func (m *echoMsg) String() string { return fmt.Sprintf("%+v", *m) }
+func (*echoMsg) ProtoMessage()    {}
+
+// 以下三个消息对应erpc.proto中的Param、Request、Response
+
+type pbParam struct {
+	Type  string `protobuf:"bytes,1,opt,name=type,proto3"`
+	Value []byte `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *pbParam) Reset()         { *m = pbParam{} }
+func (m *pbParam) String() string { return fmt.Sprintf("%+v", *m) }
+func (*pbParam) ProtoMessage()    {}
+
+type pbRequest struct {
+	Type        uint32            `protobuf:"varint,1,opt,name=type,proto3"`
+	Seq         uint64            `protobuf:"varint,2,opt,name=seq,proto3"`
+	ServiceName string            `protobuf:"bytes,3,opt,name=service_name,json=serviceName,proto3"`
+	MethodName  string            `protobuf:"bytes,4,opt,name=method_name,json=methodName,proto3"`
+	Params      []*pbParam        `protobuf:"bytes,5,rep,name=params,proto3"`
+	Deadline    int64             `protobuf:"varint,6,opt,name=deadline,proto3"`
+	Metadata    map[string]string `protobuf:"bytes,7,rep,name=metadata,proto3" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Window      uint32            `protobuf:"varint,8,opt,name=window,proto3"`
+}
+
+func (m *pbRequest) Reset()         { *m = pbRequest{} }
+func (m *pbRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*pbRequest) ProtoMessage()    {}
+
+type pbResponse struct {
+	Type     uint32            `protobuf:"varint,1,opt,name=type,proto3"`
+	Code     int64             `protobuf:"zigzag64,2,opt,name=code,proto3"`
+	Message  string            `protobuf:"bytes,3,opt,name=message,proto3"`
+	DataType string            `protobuf:"bytes,4,opt,name=data_type,json=dataType,proto3"`
+	Data     []byte            `protobuf:"bytes,5,opt,name=data,proto3"`
+	Seq      uint64            `protobuf:"varint,6,opt,name=seq,proto3"`
+	Metadata map[string]string `protobuf:"bytes,7,rep,name=metadata,proto3" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Window   uint32            `protobuf:"varint,8,opt,name=window,proto3"`
+}
+
+func (m *pbResponse) Reset()         { *m = pbResponse{} }
+func (m *pbResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*pbResponse) ProtoMessage()    {}
+
+type echoService struct{}
+
+func (echoService) Echo(ctx context.Context, in *echoMsg, n int) (*echoMsg, error) {
+	if n < 0 {
+		return nil, erpc.NewError(erpc.CodeInvalidArgument, "n不能为负数")
+	}
+	if n == 0 {
+		return nil, errors.New("n不能为0")
+	}
+	erpc.SetResponseMetadata(ctx, "trace", erpc.MetadataFromContext(ctx)["trace"])
+	return &echoMsg{Text: in.Text + "!", Count: in.Count * int64(n)}, nil
+}
+
+// pipeClient 用net.Pipe连接客户端和服务端
+func pipeClient(t *testing.T) *erpc.Client {
+	codec := new(protocol.ProtobufCodec)
+	server := erpc.NewServer(&erpc.ServerOptions{
+		Protocol:            &erpc.Protocol{Codec: codec},
+		ServiceRegisterFunc: func(string) error { return nil },
+	})
+	server.Register(echoService{}, "Echo")
+	client, err := erpc.NewClient(&erpc.ClientOptions{
+		Protocol: &erpc.Protocol{Codec: codec},
+		Timeout:  2,
+		Dial: func(string) (net.Conn, error) {
+			a, b := net.Pipe()
+			go server.ServeConn(b)
+			return a, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	client := pipeClient(t)
+	ctx := erpc.WithMetadata(context.Background(), erpc.Metadata{"trace": "t-1"})
+
+	var out echoMsg
+	if err := client.CallInto(ctx, "Echo", "Echo", &out, &echoMsg{Text: "hi", Count: 2}, 3); err != nil {
+		t.Fatal(err)
+	}
+	if out.Text != "hi!" || out.Count != 6 {
+		t.Fatalf("CallInto结果错误: %+v", out)
+	}
+
+	resp, err := client.CallContext(ctx, "Echo", "Echo", &echoMsg{Text: "md"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Metadata["trace"] != "t-1" {
+		t.Fatalf("响应元数据错误: %v", resp.Metadata)
+	}
+	data, ok := resp.Data.(protocol.ProtoData)
+	if !ok {
+		t.Fatalf("响应数据类型错误: %T", resp.Data)
+	}
+	var msg echoMsg
+	if err = proto.Unmarshal(data, &msg); err != nil || msg.Text != "md!" {
+		t.Fatalf("响应数据错误: %+v %v", msg, err)
+	}
+
+	tests := []struct {
+		n    int
+		code erpc.ErrorCode
+	}{
+		{-1, erpc.CodeInvalidArgument},
+		{0, erpc.CodeUnknown},
+	}
+	for _, tt := range tests {
+		err := client.CallInto(ctx, "Echo", "Echo", &out, &echoMsg{}, tt.n)
+		var rerr *erpc.RPCError
+		if !errors.As(err, &rerr) || rerr.Code != tt.code {
+			t.Errorf("n=%d: 期望错误码%v，实际%v", tt.n, tt.code, err)
+		}
+	}
+}
+
+func TestProtobufEnvelope(t *testing.T) {
+	codec := new(protocol.ProtobufCodec)
+	param, err := erpc.GetRequestParam(&echoMsg{Text: "p"}, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := erpc.Request{
+		Type:        erpc.MessageStream,
+		Seq:         7,
+		ServiceName: "Echo",
+		MethodName:  "Echo",
+		Params:      []erpc.RequestParam{param},
+		Deadline:    1234567890,
+		Metadata:    erpc.Metadata{"k": "v"},
+		Window:      32,
+	}
+	data, err := codec.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pr pbRequest
+	if err = proto.Unmarshal(data, &pr); err != nil {
+		t.Fatal(err)
+	}
+	if pr.Type != uint32(req.Type) || pr.Seq != 7 || pr.ServiceName != "Echo" || pr.MethodName != "Echo" ||
+		pr.Deadline != req.Deadline || pr.Metadata["k"] != "v" || pr.Window != 32 || len(pr.Params) != 1 {
+		t.Fatalf("请求报文和erpc.proto不一致: %+v", pr)
+	}
+	var param0 echoMsg
+	if err = proto.Unmarshal(pr.Params[0].Value, &param0); err != nil || param0.Text != "p" {
+		t.Fatalf("参数编码错误: %+v %v", param0, err)
+	}
+
+	// 其它语言的客户端按erpc.proto编码的请求也要能解码
+	pr.Seq, pr.Metadata = 8, map[string]string{"a": "b"}
+	if data, err = proto.Marshal(&pr); err != nil {
+		t.Fatal(err)
+	}
+	var back erpc.Request
+	if err = codec.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Seq != 8 || back.Metadata["a"] != "b" || back.Window != 32 || back.Params[0].Value != param.Value {
+		t.Fatalf("请求解码错误: %+v", back)
+	}
+
+	resp := erpc.Response{
+		Type:     erpc.MessageCall,
+		Code:     int(erpc.CodeNotFound),
+		Message:  "没有这个方法",
+		Data:     &echoMsg{Text: "r", Count: -3},
+		Seq:      9,
+		Metadata: erpc.Metadata{"x": "y"},
+	}
+	if data, err = codec.Marshal(resp); err != nil {
+		t.Fatal(err)
+	}
+	var pp pbResponse
+	if err = proto.Unmarshal(data, &pp); err != nil {
+		t.Fatal(err)
+	}
+	if pp.Code != int64(erpc.CodeNotFound) || pp.Message != resp.Message || pp.DataType != "proto" ||
+		pp.Seq != 9 || pp.Metadata["x"] != "y" {
+		t.Fatalf("响应报文和erpc.proto不一致: %+v", pp)
+	}
+	var result echoMsg
+	if err = proto.Unmarshal(pp.Data, &result); err != nil || result.Text != "r" || result.Count != -3 {
+		t.Fatalf("响应数据编码错误: %+v %v", result, err)
+	}
+}
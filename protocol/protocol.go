@@ -0,0 +1,13 @@
+package protocol
+
+import (
+	"github.com/euphie/erpc"
+)
+
+// 注册编码器，引入protocol包后可以用erpc.NewProtocol按名称生成协议
+func init() {
+	erpc.RegisterCodec("json", "1", func() erpc.Codec { return new(JSONCodec) })
+	erpc.RegisterCodec("binary", "1", func() erpc.Codec { return new(BinaryCodec) })
+	erpc.RegisterCodec("msgpack", "1", func() erpc.Codec { return new(MsgpackCodec) })
+	erpc.RegisterCodec("protobuf", "1", func() erpc.Codec { return new(ProtobufCodec) })
+}
@@ -0,0 +1,37 @@
+package erpc
+
+import "context"
+
+// Instance 服务实例
+type Instance struct {
+	// 实例ID，同一个服务的实例ID不能重复
+	ID string
+	// 服务名称
+	ServiceName string
+	// 实例地址，host:port
+	Address string
+	// 权重，负载均衡使用，0表示默认权重
+	Weight int
+	// 标签
+	Tags []string
+	// 元数据，例如版本、可用区
+	Meta map[string]string
+}
+
+// Resolver 服务发现，客户端通过它查找服务的实例
+type Resolver interface {
+	// Resolve 查找服务当前可用的实例
+	Resolve(serviceName string) ([]Instance, error)
+	// Watch 监听服务的实例，每次变化后把完整的实例列表发送到返回的channel，
+	// ctx结束后关闭channel
+	Watch(ctx context.Context, serviceName string) (<-chan []Instance, error)
+}
+
+// Registry 服务注册中心，服务器注册服务时登记实例，关闭时注销
+type Registry interface {
+	Resolver
+	// Register 登记服务实例
+	Register(instance Instance) error
+	// Deregister 注销服务实例
+	Deregister(instance Instance) error
+}
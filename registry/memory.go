@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"context"
+	"sync"
+
+	"github.com/euphie/erpc"
+)
+
+// Memory 进程内的注册中心，用于测试和单进程部署
+type Memory struct {
+	mutex    sync.Mutex
+	services map[string][]erpc.Instance
+	watchers map[string]map[chan []erpc.Instance]struct{}
+}
+
+var _ erpc.Registry = (*Memory)(nil)
+
+// NewMemory 新建一个进程内的注册中心
+func NewMemory() *Memory {
+	return &Memory{
+		services: make(map[string][]erpc.Instance),
+		watchers: make(map[string]map[chan []erpc.Instance]struct{}),
+	}
+}
+
+// Register 登记服务实例，ID相同的实例会被替换
+func (m *Memory) Register(instance erpc.Instance) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	instances := m.services[instance.ServiceName]
+	for i, old := range instances {
+		if old.ID == instance.ID {
+			instances[i] = instance
+			m.notify(instance.ServiceName)
+			return nil
+		}
+	}
+	m.services[instance.ServiceName] = append(instances, instance)
+	m.notify(instance.ServiceName)
+	return nil
+}
+
+// Deregister 注销服务实例
+func (m *Memory) Deregister(instance erpc.Instance) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	instances := m.services[instance.ServiceName]
+	for i, old := range instances {
+		if old.ID == instance.ID {
+			instances = append(instances[:i:i], instances[i+1:]...)
+			if len(instances) == 0 {
+				delete(m.services, instance.ServiceName)
+			} else {
+				m.services[instance.ServiceName] = instances
+			}
+			m.notify(instance.ServiceName)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Resolve 查找服务的实例
+func (m *Memory) Resolve(serviceName string) ([]erpc.Instance, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.list(serviceName), nil
+}
+
+// Watch 监听服务的实例，先发送当前的实例列表，之后每次登记或注销后发送最新的列表，
+// 读取得慢时只保留最新的列表
+func (m *Memory) Watch(ctx context.Context, serviceName string) (<-chan []erpc.Instance, error) {
+	ch := make(chan []erpc.Instance, 1)
+	m.mutex.Lock()
+	ch <- m.list(serviceName)
+	watchers, ok := m.watchers[serviceName]
+	if !ok {
+		watchers = make(map[chan []erpc.Instance]struct{})
+		m.watchers[serviceName] = watchers
+	}
+	watchers[ch] = struct{}{}
+	m.mutex.Unlock()
+	go func() {
+		<-ctx.Done()
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		delete(watchers, ch)
+		if len(watchers) == 0 {
+			delete(m.watchers, serviceName)
+		}
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// list 服务实例列表的副本，调用时必须持有锁
+func (m *Memory) list(serviceName string) []erpc.Instance {
+	return append([]erpc.Instance(nil), m.services[serviceName]...)
+}
+
+// notify 把最新的实例列表发送给监听者，丢弃还没有读取的旧列表，调用时必须持有锁
+func (m *Memory) notify(serviceName string) {
+	instances := m.list(serviceName)
+	for ch := range m.watchers[serviceName] {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- instances
+	}
+}
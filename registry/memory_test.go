@@ -0,0 +1,89 @@
+package registry_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/euphie/erpc"
+	"github.com/euphie/erpc/internal/testutil"
+	"github.com/euphie/erpc/registry"
+)
+
+func instance(id string, address string) erpc.Instance {
+	return erpc.Instance{ID: id, ServiceName: "Who", Address: address}
+}
+
+func ids(instances []erpc.Instance) []string {
+	list := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		list = append(list, instance.ID)
+	}
+	return list
+}
+
+func TestMemoryWatch(t *testing.T) {
+	type op struct {
+		register bool
+		id       string
+	}
+	tests := []struct {
+		name string
+		ops  []op
+		want []string
+	}{
+		{"没有变化", nil, []string{}},
+		{"登记", []op{{true, "a"}}, []string{"a"}},
+		{"多次变化只保留最新的列表", []op{{true, "a"}, {true, "b"}, {true, "c"}}, []string{"a", "b", "c"}},
+		{"ID相同的实例被替换", []op{{true, "a"}, {true, "a"}}, []string{"a"}},
+		{"注销", []op{{true, "a"}, {true, "b"}, {false, "a"}}, []string{"b"}},
+		{"全部注销", []op{{true, "a"}, {false, "a"}}, []string{}},
+		{"注销不存在的实例", []op{{false, "x"}}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := registry.NewMemory()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch, err := m.Watch(ctx, "Who")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, op := range tt.ops {
+				if op.register {
+					m.Register(instance(op.id, op.id+":1"))
+				} else {
+					m.Deregister(instance(op.id, op.id+":1"))
+				}
+			}
+			// 没有读取的旧列表被丢弃，只能读到最新的一个
+			if got := ids(<-ch); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("期望%v，实际%v", tt.want, got)
+			}
+			select {
+			case list := <-ch:
+				t.Fatalf("旧的列表没有被丢弃: %v", ids(list))
+			default:
+			}
+			cancel()
+			for range ch {
+			}
+		})
+	}
+}
+
+func TestMemoryBalancedClient(t *testing.T) {
+	m := registry.NewMemory()
+	for i := 1; i <= 3; i++ {
+		testutil.Serve(t, i, m)
+	}
+	testutil.WaitInstances(t, m, 3)
+	bc, err := erpc.NewBalancedClient("Who", m, nil, testutil.ClientOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	if seen := testutil.Collect(t, bc, 9); len(seen) != 3 {
+		t.Fatalf("请求没有分配到所有实例: %v", seen)
+	}
+}
@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/euphie/erpc"
+)
+
+// 静态注册中心在配置文件中的section前缀，例如[service.UserService]
+const staticSectionPrefix = "service."
+
+// Static 静态注册中心，服务实例从erpc配置文件中读取，不支持登记和注销。
+// 每个服务一个section，每行一个实例，格式为"地址 权重 标签"，标签可以省略，
+// 多个标签用逗号分隔：
+//
+//	[service.UserService]
+//	10.0.0.1:9001 10 zone-a,canary
+//	10.0.0.2:9001 5
+type Static struct {
+	services map[string][]erpc.Instance
+}
+
+var _ erpc.Resolver = (*Static)(nil)
+
+// NewStatic 从配置文件读取服务实例
+func NewStatic(file string) (*Static, error) {
+	conf := erpc.NewConfig()
+	if err := conf.Parse(file); err != nil {
+		return nil, err
+	}
+	return NewStaticConfig(conf)
+}
+
+// NewStaticConfig 从已经解析的配置读取服务实例
+func NewStaticConfig(conf *erpc.Config) (*Static, error) {
+	s := &Static{services: make(map[string][]erpc.Instance)}
+	for _, name := range conf.Sections() {
+		if !strings.HasPrefix(name, staticSectionPrefix) {
+			continue
+		}
+		serviceName := strings.TrimPrefix(name, staticSectionPrefix)
+		section := conf.Get(name)
+		addresses := section.Keys()
+		sort.Strings(addresses)
+		for _, address := range addresses {
+			value, _ := section.String(address)
+			instance, err := parseInstance(serviceName, address, value)
+			if err != nil {
+				return nil, err
+			}
+			s.services[serviceName] = append(s.services[serviceName], instance)
+		}
+	}
+	return s, nil
+}
+
+// parseInstance 解析一行实例配置，value为地址后面的"权重 标签"
+func parseInstance(serviceName string, address string, value string) (instance erpc.Instance, err error) {
+	instance = erpc.Instance{ID: address, ServiceName: serviceName, Address: address}
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return instance, fmt.Errorf("服务 %s 的实例 %s 配置错误: %s", serviceName, address, value)
+	}
+	if instance.Weight, err = strconv.Atoi(fields[0]); err != nil || instance.Weight < 0 {
+		return instance, fmt.Errorf("服务 %s 的实例 %s 权重错误: %s", serviceName, address, fields[0])
+	}
+	if len(fields) > 1 {
+		instance.Tags = strings.Split(fields[1], ",")
+	}
+	return
+}
+
+// Resolve 查找服务的实例
+func (s *Static) Resolve(serviceName string) ([]erpc.Instance, error) {
+	return append([]erpc.Instance(nil), s.services[serviceName]...), nil
+}
+
+// Watch 实例不会变化，只发送一次实例列表，ctx结束后关闭channel
+func (s *Static) Watch(ctx context.Context, serviceName string) (<-chan []erpc.Instance, error) {
+	ch := make(chan []erpc.Instance, 1)
+	ch <- append([]erpc.Instance(nil), s.services[serviceName]...)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch, nil
+}
@@ -0,0 +1,96 @@
+package registry_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/euphie/erpc"
+	"github.com/euphie/erpc/internal/testutil"
+	"github.com/euphie/erpc/registry"
+)
+
+func parseStatic(text string) (*registry.Static, error) {
+	conf := erpc.NewConfig()
+	if err := conf.ParseReader(strings.NewReader(text)); err != nil {
+		return nil, err
+	}
+	return registry.NewStaticConfig(conf)
+}
+
+func TestStaticParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		service string
+		want    []erpc.Instance
+		wantErr bool
+	}{
+		{
+			name:    "权重和标签",
+			config:  "[service.User]\n10.0.0.2:9001 5\n10.0.0.1:9001 10 zone-a,canary\n",
+			service: "User",
+			want: []erpc.Instance{
+				{ID: "10.0.0.1:9001", ServiceName: "User", Address: "10.0.0.1:9001", Weight: 10, Tags: []string{"zone-a", "canary"}},
+				{ID: "10.0.0.2:9001", ServiceName: "User", Address: "10.0.0.2:9001", Weight: 5},
+			},
+		},
+		{
+			name:    "忽略其它section",
+			config:  "[server]\naddress :9000\n[service.User]\n10.0.0.1:9001 1\n[service.Order]\n10.0.0.3:9001 1\n",
+			service: "Order",
+			want:    []erpc.Instance{{ID: "10.0.0.3:9001", ServiceName: "Order", Address: "10.0.0.3:9001", Weight: 1}},
+		},
+		{
+			name:    "服务不存在",
+			config:  "[service.User]\n10.0.0.1:9001 1\n",
+			service: "Order",
+			want:    []erpc.Instance{},
+		},
+		{name: "缺少权重", config: "[service.User]\n10.0.0.1:9001\n", wantErr: true},
+		{name: "权重不是数字", config: "[service.User]\n10.0.0.1:9001 x\n", wantErr: true},
+		{name: "权重为负数", config: "[service.User]\n10.0.0.1:9001 -1\n", wantErr: true},
+		{name: "多余的字段", config: "[service.User]\n10.0.0.1:9001 1 a b\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseStatic(tt.config)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("期望返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := s.Resolve(tt.service)
+			if got == nil {
+				got = []erpc.Instance{}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("期望%+v，实际%+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestStaticBalancedClient(t *testing.T) {
+	var lines []string
+	for i := 1; i <= 3; i++ {
+		lines = append(lines, fmt.Sprintf("%s 1", testutil.Serve(t, i, nil)))
+	}
+	s, err := parseStatic("[service.Who]\n" + strings.Join(lines, "\n") + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := erpc.NewBalancedClient("Who", s, nil, testutil.ClientOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	if seen := testutil.Collect(t, bc, 9); len(seen) != 3 {
+		t.Fatalf("请求没有分配到所有实例: %v", seen)
+	}
+}
@@ -1,23 +1,51 @@
 package erpc
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"net"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ServiceRegisterFunc 服务注册后候执行的方法
 type ServiceRegisterFunc func(serviceName string) error
 
+// ServiceDeregisterFunc 服务器关闭时对每个注册过的服务执行的方法
+type ServiceDeregisterFunc func(serviceName string) error
+
 // ServerOptions PRC服务器选项
 type ServerOptions struct {
-	Address             string
-	Protocol            *Protocol
-	ServiceRegisterFunc ServiceRegisterFunc
+	Address               string
+	Protocol              *Protocol
+	ServiceRegisterFunc   ServiceRegisterFunc
+	ServiceDeregisterFunc ServiceDeregisterFunc
+	// 每个连接同时处理的最大请求数，默认100，达到上限后新的请求等待名额，等待时仍然会超时或者被取消；流式方法不占用名额
+	MaxConcurrentPerConn int
+	// 每个连接排队和处理中的最大请求数，包括流式方法，默认是MaxConcurrentPerConn的两倍；
+	// 超过后新的请求直接返回CodeResourceExhausted
+	MaxPendingPerConn int
+	// 服务器同时处理的最大请求数，0表示不限制
+	MaxConcurrent int
+	// 写超时，一个响应超过这个时间没有写完时断开连接，默认10秒
+	WriteTimeout time.Duration
+	// 拦截器，按顺序包裹方法调用，第一个在最外层
+	Interceptors []ServerInterceptor
+	// 注册中心，不为空时开始监听后登记所有服务的实例，停止服务或者关闭时注销
+	Registry Registry
+	// 在注册中心登记的地址，为空时使用监听的地址；host为空或者0.0.0.0时使用本机的IP
+	Advertise string
+	// 在注册中心登记的权重、标签和元数据，例如version、zone
+	Weight int
+	Tags   []string
+	Meta   map[string]string
 }
 
+// 每个连接默认同时处理的最大请求数
+const defaultMaxConcurrentPerConn = 100
+
 // Service 服务
 type Service struct {
 	name      string
@@ -30,14 +58,99 @@ type Service struct {
 type SerivceMethod struct {
 	method reflect.Method
 	rvalue reflect.Value
+	// 第一个参数是否为context.Context
+	withContext bool
+	// 返回值形式
+	out int
+	// 最后一个参数是否为*ServerStream
+	stream bool
+}
+
+const (
+	// outResponse 返回Response
+	outResponse = iota
+	// outValueError 返回(T, error)
+	outValueError
+	// outError 只返回error
+	outError
+)
+
+var (
+	responseType = reflect.TypeOf(Response{})
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// numIn 方法需要的请求参数个数，不包括context.Context和*ServerStream
+func (method *SerivceMethod) numIn() int {
+	n := method.method.Type.NumIn() - 1
+	if method.withContext {
+		n--
+	}
+	if method.stream {
+		n--
+	}
+	return n
+}
+
+// inType 第i个请求参数对应的方法参数类型
+func (method *SerivceMethod) inType(i int) reflect.Type {
+	if method.withContext {
+		i++
+	}
+	return method.method.Type.In(i + 1)
+}
+
+// checkOut 检查方法的返回值形式
+func checkOut(mtype reflect.Type) (out int, ok bool) {
+	switch mtype.NumOut() {
+	case 1:
+		if mtype.Out(0) == responseType {
+			return outResponse, true
+		}
+		if mtype.Out(0) == errorType {
+			return outError, true
+		}
+	case 2:
+		if mtype.Out(1) == errorType {
+			return outValueError, true
+		}
+	}
+	return
+}
+
+// wrap 把方法的返回值包装成Response
+func (method *SerivceMethod) wrap(outs []reflect.Value) (resp Response) {
+	if method.out == outResponse {
+		return outs[0].Interface().(Response)
+	}
+	if err, _ := outs[len(outs)-1].Interface().(error); err != nil {
+		return errorResponse(err)
+	}
+	if method.out == outValueError {
+		resp.Data = outs[0].Interface()
+	}
+	return
 }
 
 // Server PRC服务器
 type Server struct {
 	mutex      sync.RWMutex
 	options    *ServerOptions
-	listener   *net.Listener
 	serviceMap map[string]*Service
+	// 保护listener、conns和closed
+	connMutex sync.Mutex
+	listener  net.Listener
+	conns     map[*serverConn]struct{}
+	closed    bool
+	// 全局的并发限制，为nil时不限制
+	slots chan struct{}
+	// 以下字段由mutex保护
+	// 在注册中心登记的地址
+	advertise string
+	// 是否正在监听，监听期间注册的服务立即登记
+	listening bool
+	// 已经在注册中心登记的实例，key为实例ID
+	published map[string]Instance
 }
 
 // NewServer 新建一个RPC服务器
@@ -45,6 +158,12 @@ func NewServer(options *ServerOptions) (server *Server) {
 	server = new(Server)
 	server.options = options
 	server.serviceMap = make(map[string]*Service)
+	server.conns = make(map[*serverConn]struct{})
+	if options.MaxConcurrent > 0 {
+		server.slots = make(chan struct{}, options.MaxConcurrent)
+	}
+	server.published = make(map[string]Instance)
+	server.advertise = advertiseAddress(options.Advertise, options.Address)
 	return
 }
 
@@ -82,7 +201,17 @@ func (server *Server) Register(service interface{}, alias string) {
 		value := _service.rvalue.Method(i)
 		method := _service.rtype.Method(i)
 		incheck := true
-		for j := 1; j < method.Type.NumIn(); j++ {
+		withContext := method.Type.NumIn() > 1 && method.Type.In(1) == contextType
+		first := 1
+		if withContext {
+			first = 2
+		}
+		last := method.Type.NumIn()
+		stream := last > first && method.Type.In(last-1) == serverStreamType
+		if stream {
+			last--
+		}
+		for j := first; j < last; j++ {
 			intype := method.Type.In(j)
 			if !checkIn(intype) {
 				incheck = false
@@ -92,99 +221,440 @@ func (server *Server) Register(service interface{}, alias string) {
 		if !incheck {
 			continue
 		}
-		if method.Type.NumOut() != 1 {
-			continue
-		}
-		if method.Type.Out(0) != reflect.TypeOf(Response{}) {
+		out, ok := checkOut(method.Type)
+		if !ok || stream && out != outError {
 			continue
 		}
 		Info("发现方法: %s", method.Name)
 		_service.methodMap[method.Name] = &SerivceMethod{
-			rvalue: value,
-			method: method,
+			rvalue:      value,
+			method:      method,
+			withContext: withContext,
+			out:         out,
+			stream:      stream,
 		}
 	}
-	if err := server.options.ServiceRegisterFunc(name); err != nil {
-		Error("服务注册失败: %s", err.Error())
-		return
+	if server.options.ServiceRegisterFunc != nil {
+		if err := server.options.ServiceRegisterFunc(name); err != nil {
+			Error("服务注册失败: %s", err.Error())
+			return
+		}
 	}
 	server.serviceMap[name] = _service
 	Info("服务 %s 注册成功", name)
+	if server.listening {
+		server.publish(name)
+	}
 }
 
-// Start 启动RPC服务器
-func (server *Server) Start() {
+// publish 在注册中心登记服务的实例，调用时必须持有mutex
+func (server *Server) publish(name string) {
+	if server.options.Registry == nil {
+		return
+	}
+	instance := server.instance(name)
+	if err := server.options.Registry.Register(instance); err != nil {
+		Error("服务 %s 登记失败: %s", name, err.Error())
+		return
+	}
+	server.published[instance.ID] = instance
+}
+
+// startPublish 开始监听后登记所有服务，客户端不会在监听之前发现这个实例
+func (server *Server) startPublish(addr net.Addr) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.options.Advertise == "" {
+		server.advertise = advertiseAddress("", addr.String())
+	}
+	server.listening = true
+	for name := range server.serviceMap {
+		server.publish(name)
+	}
+}
+
+// stopPublish 注销登记过的实例，Serve返回或者服务器关闭时调用，可以重复调用
+func (server *Server) stopPublish() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.listening = false
+	for id, instance := range server.published {
+		if err := server.options.Registry.Deregister(instance); err != nil {
+			Error("服务 %s 注销失败: %s", instance.ServiceName, err.Error())
+		}
+		delete(server.published, id)
+	}
+}
+
+// instance 服务在注册中心登记的实例，同一个服务的多个实例用地址区分
+func (server *Server) instance(name string) Instance {
+	return Instance{
+		ID:          name + "-" + server.advertise,
+		ServiceName: name,
+		Address:     server.advertise,
+		Weight:      server.options.Weight,
+		Tags:        server.options.Tags,
+		Meta:        server.options.Meta,
+	}
+}
+
+// advertiseAddress 在注册中心登记的地址，advertise为空时使用监听的地址
+func advertiseAddress(advertise string, listen string) string {
+	address := advertise
+	if address == "" {
+		address = listen
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		if local := localIP(); local != "" {
+			host = local
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// localIP 本机第一个非回环的IPv4地址
+func localIP() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return ipnet.IP.String()
+		}
+	}
+	return ""
+}
+
+// Start 启动RPC服务器，Shutdown或Close之后返回ErrServerClosed
+func (server *Server) Start() error {
 	listener, err := net.Listen("tcp", server.options.Address)
 	if err != nil {
 		Error("监听失败: %s", err.Error())
-	} else {
-		Info("监听地址: %s", server.options.Address)
+		return err
 	}
+	Info("监听地址: %s", server.options.Address)
+	return server.Serve(listener)
+}
 
-	server.listener = &listener
+// Serve 在listener上接受连接，Shutdown或Close之后返回ErrServerClosed
+func (server *Server) Serve(listener net.Listener) error {
+	server.connMutex.Lock()
+	if server.closed {
+		server.connMutex.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	server.listener = listener
+	server.connMutex.Unlock()
+	server.startPublish(listener.Addr())
+	defer server.stopPublish()
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if server.isClosed() {
+				return ErrServerClosed
+			}
 			Error("连接失败: %s", err.Error())
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
 		}
 		go server.handleConn(conn)
 	}
 }
 
+// ServeConn 在一个已经建立的连接上提供服务，直到连接断开
+func (server *Server) ServeConn(conn net.Conn) {
+	server.handleConn(conn)
+}
+
 func (server *Server) handleConn(conn net.Conn) {
+	// 握手之前就记录连接，Shutdown和Close才能关闭还没有发送数据的连接
+	sc := newServerConn(conn, server.options)
+	if !server.trackConn(sc) {
+		conn.Close()
+		return
+	}
+	defer server.untrackConn(sc)
+	bconn, protocol, err := serverHandshake(conn, server.options.Protocol)
+	if err != nil {
+		if err != io.EOF && !server.isClosed() {
+			Error(err.Error())
+		}
+		conn.Close()
+		return
+	}
+	server.ready(sc, bconn, protocol.Codec)
+	defer sc.cancelAll()
 	for {
-		err := server.execute(conn)
+		// 有数据可读时先把连接记为活跃，Shutdown不会在读取请求的过程中把连接当作空闲连接关闭
+		err = bconn.wait()
+		if err == nil && !server.begin(sc) {
+			err = ErrServerClosed
+		}
+		var req Request
+		if err == nil {
+			if req, err = sc.codec.GetRequest(sc); err != nil {
+				sc.done()
+			}
+		}
 		if err != nil {
-			if err != io.EOF {
-				Error(err.Error())
+			if err != io.EOF && !server.isClosed() {
+				Error("获取请求失败: %s", err.Error())
 			}
 			conn.Close()
 			break
 		}
+		switch req.Type {
+		case MessageHeartbeat:
+			// 心跳响应可能排在大的流消息后面，在后台写入，不阻塞读取循环；
+			// 上一个心跳响应还没有写完时不再重复写入
+			if atomic.CompareAndSwapInt32(&sc.pinging, 0, 1) {
+				go func(seq uint64) {
+					defer atomic.StoreInt32(&sc.pinging, 0)
+					if err := server.response(sc, &Response{Type: MessageHeartbeat, Seq: seq}); err != nil {
+						Error(err.Error())
+						conn.Close()
+					}
+				}(req.Seq)
+			}
+		case MessageCancel:
+			sc.cancel(req.Seq)
+		case MessageStream, MessageStreamEnd:
+			if stream := sc.stream(req.Seq); stream != nil {
+				stream.inbox.push(req)
+			}
+		case MessageWindow:
+			if stream := sc.stream(req.Seq); stream != nil {
+				stream.window.grant(int(req.Window))
+			}
+		default:
+			if !sc.enqueue() {
+				err = server.reject(sc, req)
+				break
+			}
+			if server.streaming(&req) {
+				sc.openStream(req.Seq)
+			}
+			// 请求处理完成后才算结束读取；并发名额在处理请求的goroutine中占用，
+			// 读取循环不会阻塞，取消、心跳和流消息总是能及时读取
+			go func(req Request) {
+				defer sc.done()
+				defer sc.dequeue()
+				if err := server.execute(sc, &req); err != nil {
+					Error(err.Error())
+					conn.Close()
+				}
+			}(req)
+			continue
+		}
+		sc.done()
+		if err != nil {
+			Error(err.Error())
+			conn.Close()
+			break
+		}
 	}
 }
 
-func (server *Server) execute(conn net.Conn) (err error) {
-	req, err := server.options.Protocol.Codec.GetRequest(conn)
-	if err != nil {
-		if err != io.EOF {
-			err = fmt.Errorf("获取请求失败: %s", err.Error())
-		}
-		return
+// reject 连接上排队的请求太多时直接拒绝，不创建处理请求的goroutine；拒绝的响应在后台写入，
+// 后台写入的响应也太多时在读取循环中写入，客户端不读取响应时不再继续读取它的请求
+func (server *Server) reject(conn *serverConn, req Request) error {
+	err := NewError(CodeResourceExhausted, "连接上排队的请求太多: %d", cap(conn.queue))
+	select {
+	case conn.rejects <- struct{}{}:
+	default:
+		return server.fail(conn, &req, err)
 	}
-	defer func() {
-		if p := recover(); p != nil {
-			resp := new(Response)
-			resp.Code = -10000
-			resp.Message = fmt.Sprintf("方法调用失败: %v", p)
-			resp.Seq = req.Seq
-			server.response(conn, resp)
+	if !server.begin(conn) {
+		<-conn.rejects
+		return nil
+	}
+	go func() {
+		defer conn.done()
+		defer func() { <-conn.rejects }()
+		if err := server.fail(conn, &req, err); err != nil {
+			Error(err.Error())
+			conn.Close()
 		}
 	}()
+	return nil
+}
+
+// acquire 占用连接和服务器的并发名额，没有名额时等待，请求被取消或者超时时返回错误
+func (server *Server) acquire(ctx context.Context, conn *serverConn) error {
+	select {
+	case conn.slots <- struct{}{}:
+	case <-ctx.Done():
+		return contextError(ctx.Err())
+	}
+	if server.slots == nil {
+		return nil
+	}
+	select {
+	case server.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		<-conn.slots
+		return contextError(ctx.Err())
+	}
+}
+
+// release 方法返回后归还并发名额
+func (server *Server) release(conn *serverConn) {
+	if server.slots != nil {
+		<-server.slots
+	}
+	<-conn.slots
+}
+
+// getMethod 查找请求的服务方法
+func (server *Server) getMethod(req *Request) (method *SerivceMethod, err error) {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
 	service, ok := server.serviceMap[req.ServiceName]
 	if !ok {
-		err = fmt.Errorf("服务不存在: %s", req.ServiceName)
-		return
+		return nil, NewError(CodeNotFound, "服务不存在: %s", req.ServiceName)
 	}
-	method, ok := service.methodMap[req.MethodName]
-	fmt.Printf("%v", service.methodMap)
+	method, ok = service.methodMap[req.MethodName]
 	if !ok {
-		err = fmt.Errorf("方法不存在: %s", req.MethodName)
-		return
+		return nil, NewError(CodeNotFound, "方法不存在: %s.%s", req.ServiceName, req.MethodName)
+	}
+	return
+}
+
+// streaming 请求的是否为流式方法
+func (server *Server) streaming(req *Request) bool {
+	method, err := server.getMethod(req)
+	return err == nil && method.stream
+}
+
+// execute 处理一个请求，和同一连接上的其它请求并发执行；
+// 服务方法不存在或者参数错误时只返回这个请求的失败响应，不影响连接上的其它请求；
+// 单向请求不返回响应
+func (server *Server) execute(conn *serverConn, req *Request) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			server.fail(conn, req, NewError(CodeInternal, "方法调用失败: %v", p))
+		}
+	}()
+	method, err := server.getMethod(req)
+	if err != nil {
+		return server.fail(conn, req, err)
+	}
+	if method.stream {
+		defer conn.closeStream(req.Seq)
+	}
+	if len(req.Params) != method.numIn() {
+		return server.fail(conn, req, NewError(CodeInvalidArgument, "参数个数不匹配: 需要%d个, 实际为%d个", method.numIn(), len(req.Params)))
 	}
 
-	params := make([]reflect.Value, len(req.Params))
+	ctx, cancel := newServerContext(conn, req)
+	conn.track(req.Seq, cancel)
+	defer conn.untrack(req.Seq)
+	params := make([]interface{}, len(req.Params))
 	for i, p := range req.Params {
-		params[i] = reflect.ValueOf(p.GetValue())
+		value, err := p.Decode(conn.codec, method.inType(i))
+		if err != nil {
+			return server.fail(conn, req, err)
+		}
+		params[i] = value.Interface()
+	}
+	var stream *ServerStream
+	if method.stream {
+		stream = conn.openStream(req.Seq)
+		stream.ctx = ctx
+	}
+	// 流的生命周期由客户端决定，不占用并发名额，否则流会一直占着名额让同一连接上的其它请求无法执行
+	release := func() {}
+	if stream == nil {
+		if err = server.acquire(ctx, conn); err != nil {
+			return server.fail(conn, req, err)
+		}
+		release = func() { server.release(conn) }
+	}
+	info, _ := RequestInfoFromContext(ctx)
+	resp := server.invoke(ctx, info, method, params, stream, release)
+	if stream != nil {
+		stream.finish()
+	}
+	if req.Type == MessageNotify {
+		if resp.Failed() {
+			Warn("单向请求 %s.%s 执行失败: %s", req.ServiceName, req.MethodName, resp.Message)
+		}
+		return
 	}
-	resps := method.rvalue.Call(params)
-	resp := resps[0].Interface().(Response)
 	resp.Seq = req.Seq
+	mergeResponseMetadata(ctx, &resp)
 	return server.response(conn, &resp)
 }
 
-func (server *Server) response(conn net.Conn, resp *Response) (err error) {
-	err = server.options.Protocol.Codec.SendResponse(conn, *resp)
+// invoke 经过拦截器调用方法，超过请求的截止时间后不再等待，直接返回超时响应；
+// 流式方法的stream不为nil，作为最后一个参数传给方法；方法真正返回后才调用release归还并发名额
+func (server *Server) invoke(ctx context.Context, info *RequestInfo, method *SerivceMethod, params []interface{}, stream *ServerStream, release func()) Response {
+	handler := func(ctx context.Context, params []interface{}) Response {
+		in := make([]reflect.Value, 0, len(params)+1)
+		if method.withContext {
+			in = append(in, reflect.ValueOf(ctx))
+		}
+		for _, p := range params {
+			in = append(in, reflect.ValueOf(p))
+		}
+		if stream != nil {
+			in = append(in, reflect.ValueOf(stream))
+		}
+		return method.wrap(method.rvalue.Call(in))
+	}
+	handler = chainServerInterceptors(server.options.Interceptors, info, handler)
+	done := make(chan Response, 1)
+	go func() {
+		defer release()
+		defer func() {
+			if p := recover(); p != nil {
+				done <- errorResponse(NewError(CodeInternal, "方法调用失败: %v", p))
+			}
+		}()
+		done <- handler(ctx, params)
+	}()
+	select {
+	case resp := <-done:
+		return resp
+	case <-ctx.Done():
+		if ctx.Err() == context.Canceled {
+			return errorResponse(NewError(CodeCanceled, "请求已取消"))
+		}
+		return errorResponse(NewError(CodeDeadlineExceeded, "方法执行超时"))
+	}
+}
+
+// fail 返回请求的失败响应
+func (server *Server) fail(conn *serverConn, req *Request, err error) error {
+	if req.Type == MessageNotify {
+		Warn("单向请求 %s.%s 执行失败: %s", req.ServiceName, req.MethodName, err.Error())
+		return nil
+	}
+	resp := errorResponse(err)
+	resp.Seq = req.Seq
+	return server.response(conn, &resp)
+}
+
+// response 写入响应，返回的错误都是连接的错误；结果不能编码时改为返回CodeInternal错误，不影响连接上的其它请求
+func (server *Server) response(conn *serverConn, resp *Response) (err error) {
+	if resp.Data != nil {
+		if _, err = conn.codec.Marshal(resp.Data); err != nil {
+			failed := errorResponse(NewError(CodeInternal, "响应编码失败: %s", err.Error()))
+			failed.Type, failed.Seq = resp.Type, resp.Seq
+			resp = &failed
+		}
+	}
+	err = conn.send(resp)
 	Info("%v", *resp)
 	return
 }
@@ -0,0 +1,299 @@
+package erpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed 服务器已经关闭
+var ErrServerClosed = NewError(CodeUnavailable, "服务器已关闭")
+
+// Shutdown检查连接是否空闲的间隔
+const shutdownPollInterval = 10 * time.Millisecond
+
+// serverConn 服务端的连接
+type serverConn struct {
+	net.Conn
+	// 协商后使用的编码器
+	codec Codec
+	// 写入锁，响应和控制消息可能同时写入
+	writeMutex sync.Mutex
+	// 写超时
+	writeTimeout time.Duration
+	// 是否有心跳响应正在等待写入
+	pinging int32
+	// 正在处理的请求数
+	active int32
+	// 连接的并发限制
+	slots chan struct{}
+	// 排队和处理中的请求，满了之后新的请求直接拒绝
+	queue chan struct{}
+	// 正在后台写入的拒绝响应
+	rejects chan struct{}
+	// 保护cancels和streams
+	cancelMutex sync.Mutex
+	// 正在处理的请求，收到取消消息时取消对应的context
+	cancels map[uint64]context.CancelFunc
+	// 正在处理的流式请求，收到的流消息交给对应的流
+	streams map[uint64]*ServerStream
+}
+
+// newServerConn 握手之前创建连接，握手完成后由ready设置编码器
+func newServerConn(conn net.Conn, options *ServerOptions) *serverConn {
+	maxConcurrent := options.MaxConcurrentPerConn
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrentPerConn
+	}
+	maxPending := options.MaxPendingPerConn
+	if maxPending <= 0 {
+		maxPending = 2 * maxConcurrent
+	}
+	writeTimeout := options.WriteTimeout
+	if writeTimeout <= 0 {
+		writeTimeout = defaultWriteTimeout
+	}
+	return &serverConn{
+		Conn:         conn,
+		writeTimeout: writeTimeout,
+		slots:        make(chan struct{}, maxConcurrent),
+		queue:        make(chan struct{}, maxPending),
+		rejects:      make(chan struct{}, maxConcurrent),
+		cancels:      make(map[uint64]context.CancelFunc),
+		streams:      make(map[uint64]*ServerStream),
+	}
+}
+
+// enqueue 请求开始排队，排队和处理中的请求已满时返回false
+func (conn *serverConn) enqueue() bool {
+	select {
+	case conn.queue <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// dequeue 请求处理完成，离开队列
+func (conn *serverConn) dequeue() {
+	<-conn.queue
+}
+
+// track 记录正在处理的请求
+func (conn *serverConn) track(seq uint64, cancel context.CancelFunc) {
+	conn.cancelMutex.Lock()
+	defer conn.cancelMutex.Unlock()
+	conn.cancels[seq] = cancel
+}
+
+// untrack 请求处理完成
+func (conn *serverConn) untrack(seq uint64) {
+	conn.cancelMutex.Lock()
+	cancel, ok := conn.cancels[seq]
+	delete(conn.cancels, seq)
+	conn.cancelMutex.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// cancelAll 连接断开后取消所有正在处理的请求
+func (conn *serverConn) cancelAll() {
+	conn.cancelMutex.Lock()
+	defer conn.cancelMutex.Unlock()
+	for _, cancel := range conn.cancels {
+		cancel()
+	}
+}
+
+// cancel 客户端放弃了请求，取消请求的context
+func (conn *serverConn) cancel(seq uint64) {
+	conn.cancelMutex.Lock()
+	cancel, ok := conn.cancels[seq]
+	conn.cancelMutex.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// openStream 读取到流式请求时立即建立流，之后读取到的流消息才不会丢失
+func (conn *serverConn) openStream(seq uint64) *ServerStream {
+	conn.cancelMutex.Lock()
+	defer conn.cancelMutex.Unlock()
+	stream, ok := conn.streams[seq]
+	if !ok {
+		stream = newServerStream(conn, seq)
+		conn.streams[seq] = stream
+	}
+	return stream
+}
+
+// stream 查找正在处理的流，流已经结束时返回nil
+func (conn *serverConn) stream(seq uint64) *ServerStream {
+	conn.cancelMutex.Lock()
+	defer conn.cancelMutex.Unlock()
+	return conn.streams[seq]
+}
+
+func (conn *serverConn) closeStream(seq uint64) {
+	conn.cancelMutex.Lock()
+	defer conn.cancelMutex.Unlock()
+	delete(conn.streams, seq)
+}
+
+// send 写入一个响应
+func (conn *serverConn) send(resp *Response) error {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(conn.writeTimeout))
+	return conn.codec.SendResponse(conn, *resp)
+}
+
+// idle 没有正在读取或者处理的请求
+func (conn *serverConn) idle() bool {
+	return atomic.LoadInt32(&conn.active) == 0
+}
+
+// done 一个消息读取或者处理完成
+func (conn *serverConn) done() {
+	atomic.AddInt32(&conn.active, -1)
+}
+
+func (server *Server) isClosed() bool {
+	server.connMutex.Lock()
+	defer server.connMutex.Unlock()
+	return server.closed
+}
+
+// trackConn 记录连接，服务器已经关闭时返回false
+func (server *Server) trackConn(conn *serverConn) bool {
+	server.connMutex.Lock()
+	defer server.connMutex.Unlock()
+	if server.closed {
+		return false
+	}
+	server.conns[conn] = struct{}{}
+	return true
+}
+
+// ready 握手完成，设置协商后的连接和编码器
+func (server *Server) ready(conn *serverConn, bconn net.Conn, codec Codec) {
+	server.connMutex.Lock()
+	defer server.connMutex.Unlock()
+	conn.Conn, conn.codec = bconn, codec
+}
+
+// begin 开始读取一个消息，和closeIdleConns互斥，连接已经作为空闲连接被关闭时返回false
+func (server *Server) begin(conn *serverConn) bool {
+	server.connMutex.Lock()
+	defer server.connMutex.Unlock()
+	if _, ok := server.conns[conn]; !ok {
+		return false
+	}
+	atomic.AddInt32(&conn.active, 1)
+	return true
+}
+
+func (server *Server) untrackConn(conn *serverConn) {
+	server.connMutex.Lock()
+	defer server.connMutex.Unlock()
+	delete(server.conns, conn)
+}
+
+// beginClose 停止接受新连接并注销服务，返回当前已经完成握手的连接
+func (server *Server) beginClose() (conns []*serverConn, err error) {
+	server.connMutex.Lock()
+	if server.closed {
+		server.connMutex.Unlock()
+		return nil, ErrServerClosed
+	}
+	server.closed = true
+	if server.listener != nil {
+		err = server.listener.Close()
+	}
+	for conn := range server.conns {
+		if conn.codec != nil {
+			conns = append(conns, conn)
+		}
+	}
+	server.connMutex.Unlock()
+	server.deregister()
+	return
+}
+
+// deregister 注销所有注册过的服务
+func (server *Server) deregister() {
+	server.stopPublish()
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	if server.options.ServiceDeregisterFunc == nil {
+		return
+	}
+	for name := range server.serviceMap {
+		if err := server.options.ServiceDeregisterFunc(name); err != nil {
+			Error("服务 %s 注销失败: %s", name, err.Error())
+		}
+	}
+}
+
+// Shutdown 优雅关闭服务器：停止接受新连接，通知客户端不要在现有连接上发送新请求，
+// 等正在处理的请求完成后关闭连接。ctx结束时关闭剩余的连接并返回ctx.Err()
+func (server *Server) Shutdown(ctx context.Context) error {
+	conns, err := server.beginClose()
+	if err == ErrServerClosed {
+		return err
+	}
+	for _, conn := range conns {
+		if err := conn.send(&Response{Type: MessageGoAway}); err != nil {
+			conn.Close()
+		}
+	}
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if server.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			server.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close 立即关闭服务器和所有连接，正在处理的请求不会再返回响应
+func (server *Server) Close() error {
+	_, err := server.beginClose()
+	if err == ErrServerClosed {
+		return err
+	}
+	server.closeConns()
+	return err
+}
+
+// closeIdleConns 关闭空闲的连接，返回是否所有连接都已关闭
+func (server *Server) closeIdleConns() bool {
+	server.connMutex.Lock()
+	defer server.connMutex.Unlock()
+	for conn := range server.conns {
+		if conn.idle() {
+			conn.Close()
+			delete(server.conns, conn)
+		}
+	}
+	return len(server.conns) == 0
+}
+
+// closeConns 关闭所有连接
+func (server *Server) closeConns() {
+	server.connMutex.Lock()
+	defer server.connMutex.Unlock()
+	for conn := range server.conns {
+		conn.Close()
+		delete(server.conns, conn)
+	}
+}
@@ -0,0 +1,80 @@
+package erpc_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/euphie/erpc"
+	"github.com/euphie/erpc/internal/testutil"
+	"github.com/euphie/erpc/registry"
+)
+
+func TestServerPublish(t *testing.T) {
+	m := registry.NewMemory()
+	server := testutil.NewServer(t, 1, m)
+	// 注册了服务但是还没有监听，不应该被发现
+	if instances, _ := m.Resolve("Who"); len(instances) != 0 {
+		t.Fatalf("监听之前就登记了实例: %v", instances)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(listener) }()
+	instances := testutil.WaitInstances(t, m, 1)
+	if instances[0].Address != listener.Addr().String() {
+		t.Fatalf("登记的地址%s和监听的地址%s不一致", instances[0].Address, listener.Addr())
+	}
+	server.Close()
+	<-done
+	testutil.WaitInstances(t, m, 0)
+}
+
+func TestServerShutdown(t *testing.T) {
+	server := newTestServer(t, newTestService(), nil)
+	client := newTestClient(t, &erpc.ClientOptions{Address: listen(t, server)})
+
+	// Shutdown等待正在处理的请求完成后才返回
+	slow := client.Go("Test", "Wait", nil, 200)
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("Shutdown没有等待正在处理的请求: %v", time.Since(start))
+	}
+	select {
+	case call := <-slow.Done:
+		if call.Error != nil || call.Resp.Err() != nil {
+			t.Fatalf("正在处理的请求失败: %v %v", call.Error, call.Resp)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("请求没有完成")
+	}
+	if err := server.Shutdown(context.Background()); err != erpc.ErrServerClosed {
+		t.Fatalf("重复Shutdown期望ErrServerClosed，实际%v", err)
+	}
+
+	// ctx超时时直接关闭还在处理请求的连接
+	server = newTestServer(t, newTestService(), nil)
+	client = newTestClient(t, &erpc.ClientOptions{Address: listen(t, server)})
+	slow = client.Go("Test", "Wait", nil, 5000)
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("期望context.DeadlineExceeded，实际%v", err)
+	}
+	select {
+	case call := <-slow.Done:
+		if erpc.Code(call.Error) != erpc.CodeUnavailable {
+			t.Fatalf("期望Unavailable，实际%v", call.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("连接关闭后请求没有失败")
+	}
+}
@@ -0,0 +1,384 @@
+package erpc
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// ErrStreamClosed 流已经关闭
+var ErrStreamClosed = NewError(CodeCanceled, "流已关闭")
+
+var serverStreamType = reflect.TypeOf((*ServerStream)(nil))
+
+// 流控窗口，每个方向最多有这么多个消息已经发送但是还没有被对方读取
+const streamWindow = 64
+
+// sendWindow 发送方的流控窗口
+type sendWindow struct {
+	mutex   sync.Mutex
+	credits int
+	closed  bool
+	// 窗口增加或者关闭时通知等待的发送方
+	ready chan struct{}
+}
+
+func newSendWindow() *sendWindow {
+	return &sendWindow{credits: streamWindow, ready: make(chan struct{}, 1)}
+}
+
+// acquire 占用一个窗口，窗口用完时阻塞，直到对方读取了消息、流关闭或者ctx结束
+func (w *sendWindow) acquire(ctx context.Context) error {
+	for {
+		w.mutex.Lock()
+		if w.closed {
+			w.mutex.Unlock()
+			return ErrStreamClosed
+		}
+		if w.credits > 0 {
+			w.credits--
+			more := w.credits > 0
+			w.mutex.Unlock()
+			if more {
+				w.notify()
+			}
+			return nil
+		}
+		w.mutex.Unlock()
+		select {
+		case <-w.ready:
+		case <-ctx.Done():
+			return contextError(ctx.Err())
+		}
+	}
+}
+
+func (w *sendWindow) grant(n int) {
+	w.mutex.Lock()
+	w.credits += n
+	w.mutex.Unlock()
+	w.notify()
+}
+
+func (w *sendWindow) close() {
+	w.mutex.Lock()
+	w.closed = true
+	w.mutex.Unlock()
+	w.notify()
+}
+
+func (w *sendWindow) notify() {
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// streamQueue 收到还没有读取的流消息，长度受对方的发送窗口限制
+type streamQueue struct {
+	mutex sync.Mutex
+	items []interface{}
+	// 有新消息时通知等待的Recv
+	ready chan struct{}
+}
+
+func newStreamQueue() *streamQueue {
+	return &streamQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *streamQueue) push(v interface{}) {
+	q.mutex.Lock()
+	q.items = append(q.items, v)
+	q.mutex.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *streamQueue) pop() (v interface{}, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.items) == 0 {
+		return
+	}
+	v = q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	return v, true
+}
+
+// ServerStream 服务端流，作为方法的最后一个参数，方法必须只返回error；
+// 方法用Send向客户端推送消息，用Recv读取客户端发送的消息，两者可以在不同的goroutine中同时使用；
+// 方法返回后流结束，返回的error作为流的错误
+type ServerStream struct {
+	ctx    context.Context
+	conn   *serverConn
+	seq    uint64
+	window *sendWindow
+	inbox  *streamQueue
+	// 已经读取但是还没有归还窗口的消息数
+	recvd int
+	eof   bool
+	mutex sync.Mutex
+	// 方法已经返回
+	closed bool
+}
+
+func newServerStream(conn *serverConn, seq uint64) *ServerStream {
+	return &ServerStream{conn: conn, seq: seq, window: newSendWindow(), inbox: newStreamQueue()}
+}
+
+// Context 请求的context，客户端关闭流或者连接断开时被取消
+func (stream *ServerStream) Context() context.Context {
+	return stream.ctx
+}
+
+// Send 向客户端发送一个消息，客户端读取得慢时阻塞
+func (stream *ServerStream) Send(v interface{}) error {
+	if err := stream.window.acquire(stream.ctx); err != nil {
+		return err
+	}
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.closed {
+		return ErrStreamClosed
+	}
+	return stream.conn.send(&Response{Type: MessageStream, Seq: stream.seq, Data: v})
+}
+
+// Recv 读取客户端发送的下一个消息并解码到out中，out必须是指针；
+// 客户端调用CloseSend后返回io.EOF
+func (stream *ServerStream) Recv(out interface{}) error {
+	for {
+		if v, ok := stream.inbox.pop(); ok {
+			req := v.(Request)
+			if req.Type == MessageStreamEnd {
+				stream.eof = true
+				return io.EOF
+			}
+			stream.ack()
+			return stream.decode(req, out)
+		}
+		if stream.eof {
+			return io.EOF
+		}
+		select {
+		case <-stream.inbox.ready:
+		case <-stream.ctx.Done():
+			return contextError(stream.ctx.Err())
+		}
+	}
+}
+
+// ack 读取了一半窗口的消息后通知客户端继续发送
+func (stream *ServerStream) ack() {
+	stream.recvd++
+	if stream.recvd < streamWindow/2 {
+		return
+	}
+	resp := &Response{Type: MessageWindow, Seq: stream.seq, Window: uint32(stream.recvd)}
+	stream.recvd = 0
+	if err := stream.conn.send(resp); err != nil {
+		Warn("发送流控消息失败: %s", err.Error())
+	}
+}
+
+func (stream *ServerStream) decode(req Request, out interface{}) error {
+	if len(req.Params) != 1 {
+		return NewError(CodeInvalidArgument, "流消息格式错误")
+	}
+	ptr := reflect.ValueOf(out)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return NewError(CodeInvalidArgument, "out必须是非nil的指针")
+	}
+	value, err := req.Params[0].Decode(stream.conn.codec, ptr.Elem().Type())
+	if err != nil {
+		return err
+	}
+	ptr.Elem().Set(value)
+	return nil
+}
+
+// finish 方法返回后关闭流，之后的Send直接返回错误
+func (stream *ServerStream) finish() {
+	stream.window.close()
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.closed = true
+}
+
+// clientStreamState 流式调用在客户端的状态，由连接的接收循环更新
+type clientStreamState struct {
+	inbox  *streamQueue
+	window *sendWindow
+}
+
+// ClientStream 客户端流，Recv和Send可以在不同的goroutine中同时使用，
+// 但是不能在多个goroutine中同时Recv或者同时Send
+type ClientStream struct {
+	ctx   context.Context
+	cc    *clientConn
+	call  *Call
+	codec Codec
+	// 已经读取但是还没有归还窗口的消息数
+	recvd int
+	mutex sync.Mutex
+	// 流结束后的错误，正常结束时为io.EOF
+	err error
+	// 是否已经被Close或者ctx放弃
+	aborted    bool
+	sendClosed bool
+}
+
+// Recv 读取服务端发送的下一个消息并解码到out中，流正常结束时返回io.EOF，
+// 方法返回错误时返回*RPCError
+func (stream *ClientStream) Recv(out interface{}) error {
+	state := stream.call.stream
+	for {
+		stream.mutex.Lock()
+		aborted, err := stream.aborted, stream.err
+		stream.mutex.Unlock()
+		if aborted {
+			return err
+		}
+		if v, ok := state.inbox.pop(); ok {
+			stream.ack()
+			if err := decode(stream.codec, v.(Response).Data, out); err != nil {
+				return wrapError(CodeInternal, err)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-state.inbox.ready:
+		case call := <-stream.call.Done:
+			// 结束响应之前的消息都已经在队列中，取完之后再返回
+			err = io.EOF
+			if call.Error != nil {
+				err = call.Error
+			} else if rerr := call.Resp.Err(); rerr != nil {
+				err = rerr
+			}
+			stream.mutex.Lock()
+			stream.err = err
+			stream.mutex.Unlock()
+		case <-stream.ctx.Done():
+			stream.abort(contextError(stream.ctx.Err()))
+		}
+	}
+}
+
+// ack 读取了一半窗口的消息后通知服务端继续发送
+func (stream *ClientStream) ack() {
+	stream.recvd++
+	if stream.recvd < streamWindow/2 {
+		return
+	}
+	req := Request{Type: MessageWindow, Seq: stream.call.Req.Seq, Window: uint32(stream.recvd)}
+	stream.recvd = 0
+	if err := stream.cc.send(stream.call, req, stream.ctx.Done()); err != nil {
+		Warn("发送流控消息失败: %s", err.Error())
+	}
+}
+
+// Send 向服务端发送一个消息，服务端读取得慢时阻塞；流已经结束时返回ErrStreamClosed
+func (stream *ClientStream) Send(v interface{}) error {
+	stream.mutex.Lock()
+	closed := stream.aborted || stream.sendClosed
+	stream.mutex.Unlock()
+	if closed {
+		return ErrStreamClosed
+	}
+	rp, err := GetRequestParam(v, stream.codec)
+	if err != nil {
+		return err
+	}
+	if err = stream.call.stream.window.acquire(stream.ctx); err != nil {
+		return err
+	}
+	req := Request{Type: MessageStream, Seq: stream.call.Req.Seq, Params: []RequestParam{rp}}
+	return stream.cc.send(stream.call, req, stream.ctx.Done())
+}
+
+// CloseSend 通知服务端不会再发送消息，服务端的Recv返回io.EOF，不影响Recv
+func (stream *ClientStream) CloseSend() error {
+	stream.mutex.Lock()
+	if stream.aborted || stream.sendClosed {
+		stream.mutex.Unlock()
+		return nil
+	}
+	stream.sendClosed = true
+	stream.mutex.Unlock()
+	return stream.cc.send(stream.call, Request{Type: MessageStreamEnd, Seq: stream.call.Req.Seq}, stream.ctx.Done())
+}
+
+// Close 关闭流，通知服务端停止处理
+func (stream *ClientStream) Close() error {
+	stream.mutex.Lock()
+	done := stream.aborted || stream.err != nil
+	stream.mutex.Unlock()
+	if !done {
+		stream.abort(ErrStreamClosed)
+	}
+	return nil
+}
+
+// abort 放弃流，还没有读取的消息不再返回
+func (stream *ClientStream) abort(err error) {
+	if stream.cc.remove(stream.call.Req.Seq) != nil {
+		stream.cc.cancel(stream.call)
+	}
+	stream.call.stream.window.close()
+	stream.mutex.Lock()
+	stream.aborted = true
+	stream.err = err
+	stream.mutex.Unlock()
+}
+
+// Stream 调用流式方法，返回的ClientStream用Recv读取服务端发送的消息，用Send向服务端发送消息；
+// 只使用ctx的截止时间，不使用默认超时时间。拦截器只包裹打开流的请求，invoker在请求发送后就返回空的Response，
+// 拦截器给ctx添加的元数据和截止时间随请求发送，流的生命周期仍然由调用方的ctx决定
+func (client *Client) Stream(ctx context.Context, serviceName string, methodName string, params ...interface{}) (*ClientStream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+	cc := client.pick()
+	codec := cc.codec()
+	var stream *ClientStream
+	invoker := func(octx context.Context, params []interface{}) (Response, error) {
+		req, err := newRequest(codec, serviceName, methodName, params)
+		if err != nil {
+			return Response{}, err
+		}
+		if deadline, ok := octx.Deadline(); ok {
+			req.Deadline = deadline.UnixNano()
+		}
+		req.Metadata = MetadataFromContext(octx)
+		state := &clientStreamState{inbox: newStreamQueue(), window: newSendWindow()}
+		call := &Call{Req: req, Done: make(chan *Call, 1), stream: state}
+		if err = cc.request(call, ctx.Done()); err != nil {
+			if ctx.Err() != nil {
+				return Response{}, contextError(ctx.Err())
+			}
+			return Response{}, err
+		}
+		stream = &ClientStream{ctx: ctx, cc: cc, call: call, codec: call.conn.codec}
+		return Response{}, nil
+	}
+	info := &RequestInfo{ServiceName: serviceName, MethodName: methodName}
+	if _, err := chainClientInterceptors(client.options.Interceptors, info, invoker)(ctx, params); err != nil {
+		if stream != nil {
+			stream.Close()
+		}
+		return nil, err
+	}
+	if stream == nil {
+		// 拦截器没有调用invoker
+		return nil, NewError(CodeInternal, "拦截器没有打开流: %s.%s", serviceName, methodName)
+	}
+	return stream, nil
+}
@@ -0,0 +1,83 @@
+package erpc_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/euphie/erpc"
+	"github.com/euphie/erpc/internal/testutil"
+)
+
+func TestStreamWindow(t *testing.T) {
+	service := newTestService()
+	server := newTestServer(t, service, nil)
+	client := newTestClient(t, &erpc.ClientOptions{Dial: pipeDial(server, nil)})
+
+	stream, err := client.Stream(context.Background(), "Test", "Count", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	// 客户端不读取时服务端发送完一个窗口就停下
+	testutil.Eventually(t, "发送一个窗口", func() bool { return atomic.LoadInt32(&service.sent) > 0 })
+	time.Sleep(50 * time.Millisecond)
+	if sent := atomic.LoadInt32(&service.sent); sent > 64 {
+		t.Fatalf("客户端没有读取时发送了%d个消息", sent)
+	}
+	for i := 0; i < 1000; i++ {
+		var n int
+		if err := stream.Recv(&n); err != nil || n != i {
+			t.Fatalf("第%d个消息错误: %d %v", i, n, err)
+		}
+	}
+	if err := stream.Recv(nil); err != io.EOF {
+		t.Fatalf("流结束时期望io.EOF，实际%v", err)
+	}
+}
+
+// 双向流的两端同时发送大的消息时，心跳、流控消息和响应不能互相阻塞
+func TestStreamLargeMessagesWithHeartbeat(t *testing.T) {
+	server := newTestServer(t, newTestService(), nil)
+	client := newTestClient(t, &erpc.ClientOptions{
+		Address:           listen(t, server),
+		HeartbeatInterval: 200 * time.Millisecond,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	stream, err := client.Stream(ctx, "Test", "Chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	const n = 40
+	text := strings.Repeat("x", 1<<20)
+	sent := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := stream.Send(text); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- stream.CloseSend()
+	}()
+	for i := 0; i < n; i++ {
+		var got string
+		if err := stream.Recv(&got); err != nil || len(got) != len(text) {
+			t.Fatalf("第%d个消息错误: %d %v", i, len(got), err)
+		}
+		// 读取得比发送慢，两端的写入都会阻塞
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Recv(nil); err != io.EOF {
+		t.Fatalf("流结束时期望io.EOF，实际%v", err)
+	}
+}